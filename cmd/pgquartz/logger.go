@@ -6,7 +6,9 @@ import (
 	"github.com/mannemsolutions/PgQuartz/pkg/git"
 
 	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
+	"github.com/mannemsolutions/PgQuartz/pkg/holder"
 	"github.com/mannemsolutions/PgQuartz/pkg/jobs"
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
 	"github.com/mannemsolutions/PgQuartz/pkg/pg"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -70,7 +72,9 @@ func initLogger(logFilePath string) {
 func initRemoteLoggers() {
 	jobs.InitLogger(log, atom)
 	git.InitLogger(log)
+	holder.InitLogger(log)
 	etcd.InitLogger(log)
+	lock.InitLogger(log)
 	pg.InitLogger(log)
 }
 
@@ -2,13 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
 
 	"github.com/mannemsolutions/PgQuartz/internal"
 	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
 	"github.com/mannemsolutions/PgQuartz/pkg/jobs"
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
 	"github.com/mannemsolutions/PgQuartz/pkg/pg"
 )
 
+const (
+	// exitCodeChecksFailed is used when all steps have run, but one or more checks failed
+	exitCodeChecksFailed = 3
+	// exitCodeLockLost is used when the job was aborted, because the lock was lost while running the steps
+	exitCodeLockLost = 4
+	// exitCodeSkipped is used when the job was skipped, because the lock was held by someone else (onLocked: skip)
+	exitCodeSkipped = 5
+	// exitCodeFailed is used when the job failed while running the steps (e.a. a step could not be locked)
+	exitCodeFailed = 6
+)
+
 var (
 	jobCtx           context.Context
 	jobCtxCancelFunc context.CancelFunc
@@ -17,8 +32,14 @@ var (
 
 func initContext() {
 	jobCtx, jobCtxCancelFunc = config.GetTimeoutContext(context.Background())
+	if jobCtxCancelFunc == nil {
+		// The job context should always be cancellable, so that the job can be aborted when the lock is lost
+		jobCtx, jobCtxCancelFunc = context.WithCancel(jobCtx)
+	}
 	pg.InitContext(jobCtx)
+	jobs.InitContext(jobCtx)
 	etcd.InitContext(jobCtx)
+	lock.InitContext(jobCtx)
 }
 
 func main() {
@@ -32,6 +53,12 @@ func main() {
 		enableDebug(config.Debug)
 		config.Initialize()
 		defer log.Sync() //nolint:errcheck
+		if args := internal.Args(); len(args) > 0 {
+			if err = runCommand(args); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 		if err = config.Git.Pull(); err != nil {
 			log.Infof("error while pulling git repo %s: %e", config.Workdir, err)
 		} else {
@@ -41,21 +68,57 @@ func main() {
 			}
 		}
 		initContext()
-		locker := etcd.NewEtcdLocker(config.EtcdConfig)
-		locker.Lock()
+		locker, err := lock.NewLocker(config.Lock, config.EtcdConfig, config.Conns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = locker.Lock(); errors.Is(err, lock.ErrLocked) && config.Lock.SkipWhenLocked() {
+			log.Infof("skipping job: %s", err)
+			locker.Close()
+			jobCtxCancelFunc()
+			_ = log.Sync()
+			os.Exit(exitCodeSkipped)
+		} else if err != nil {
+			log.Fatal(err)
+		}
 		defer locker.Close()
 		h := jobs.NewHandler(config)
 		h.VerifyConfig()
 		if err = h.VerifyRoles(); err == pg.UnexpctedRole {
 			log.Infof("%s", err)
+			// The locker (e.a. postgres) can hold a session from a pool of h, which must be released before closing h
 			locker.Close()
+			h.Close()
 			return
 		} else if err != nil {
 			log.Panicf("error during role verification: %e", err)
 		}
+		if etcdLocker, ok := locker.(*etcd.Locker); ok {
+			publishStatus(etcdLocker, h)
+		}
+		h.WatchLock(locker.Lost(), config.Lock.AbortOnLost(), jobCtxCancelFunc)
 		h.RunSteps()
 		locker.Close()
-		h.RunChecks()
+		if err = h.Failure(); err != nil {
+			log.Error(err)
+			h.Config.Alert.Send(h.Config.Conns, fmt.Sprintf("the job failed and was aborted: %s", err.Error()))
+			h.Close()
+			_ = log.Sync()
+			os.Exit(exitCodeFailed)
+		}
+		if h.Aborted() {
+			h.Config.Alert.Send(h.Config.Conns, "the lock was lost while running the job, the job was aborted")
+			h.Close()
+			_ = log.Sync()
+			os.Exit(exitCodeLockLost)
+		}
+		err = h.RunChecks()
+		h.Close()
+		if err != nil {
+			log.Error(err)
+			_ = log.Sync()
+			os.Exit(exitCodeChecksFailed)
+		}
 		jobCtxCancelFunc()
 	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
+	"github.com/mannemsolutions/PgQuartz/pkg/jobs"
+)
+
+// runCommand runs the command in args (instead of the job), and returns an error when it fails
+func runCommand(args []string) error {
+	switch args[0] {
+	case "status":
+		return runStatus(args[1:])
+	}
+	return fmt.Errorf("unknown command %s", args[0])
+}
+
+// runStatus prints the status of the job (or of all running jobs with --all) as published in etcd
+func runStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	fromEtcd := flags.Bool("etcd", false, "Read the status from etcd")
+	job := flags.String("job", config.Name, "The job to show the status of")
+	all := flags.Bool("all", false, "Show the status of all running jobs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*fromEtcd {
+		return fmt.Errorf("status requires --etcd (etcd is the only source of status)")
+	}
+	if *all {
+		*job = ""
+	}
+	statuses, err := etcd.ReadStatus(config.EtcdConfig, *job)
+	if err != nil {
+		return fmt.Errorf("could not read status from etcd: %w", err)
+	}
+	if len(statuses) == 0 {
+		if *job == "" {
+			//nolint
+			fmt.Println("no jobs are running")
+		} else {
+			//nolint
+			fmt.Printf("job %s is not running\n", *job)
+		}
+		return nil
+	}
+	for _, status := range statuses {
+		out, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		//nolint
+		fmt.Println(string(out))
+	}
+	return nil
+}
+
+// publishStatus publishes the status of the running job in etcd (with the git revision, when the job is in git)
+func publishStatus(locker *etcd.Locker, h jobs.Handler) {
+	var gitRevision string
+	if config.Git.Path.IsGitRepo() {
+		gitRevision = config.Git.Path.GetCommit("HEAD")
+	}
+	status := etcd.NewStatus(config.Name, gitRevision)
+	if err := locker.PublishStatus(status, func(status *etcd.Status) {
+		status.Steps = h.StepStates()
+	}); err != nil {
+		log.Errorf("error publishing status: %e", err)
+	}
+}
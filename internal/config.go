@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/mannemsolutions/PgQuartz/pkg/jobs"
+	"github.com/mannemsolutions/PgQuartz/pkg/secrets"
 	"gopkg.in/yaml.v2"
 )
 
@@ -54,6 +55,11 @@ func ProcessFlags() (err error) {
 	return err
 }
 
+// Args returns the arguments that are left after processing the flags (e.a. a command like status)
+func Args() []string {
+	return flag.Args()
+}
+
 func NewConfig() (config jobs.Config, err error) {
 	if err = ProcessFlags(); err != nil {
 		return
@@ -65,11 +71,18 @@ func NewConfig() (config jobs.Config, err error) {
 	if err != nil {
 		return config, err
 	}
+	// Secrets are resolved before the config is parsed, so that they can be used for any value
+	if yamlConfig, err = secrets.ResolveYaml(yamlConfig); err != nil {
+		return config, err
+	}
 
 	err = yaml.Unmarshal(yamlConfig, &config)
-	config.Initialize()
 	dir, fileName := path.Split(configFile)
 	jobName := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if config.Name == "" {
+		config.Name = jobName
+	}
+	config.Initialize()
 	if config.Workdir == "" {
 		config.Workdir = dir
 	}
@@ -84,9 +97,8 @@ func NewConfig() (config jobs.Config, err error) {
 		logFileName := fmt.Sprintf("%s_%s.log", t.Format("2006-01-02"), jobName)
 		config.LogFile = filepath.Join(config.LogFile, logFileName)
 	}
-	if config.EtcdConfig.LockKey == "" {
-		config.EtcdConfig.LockKey = jobName
-	}
+	config.Lock.SetDefaults(jobName, config.EtcdConfig)
+	config.Steps.SetLockDefaults(jobName, config.Lock)
 
 	if debug {
 		config.Debug = true
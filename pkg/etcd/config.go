@@ -2,13 +2,223 @@ package etcd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
 	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+// Config configures the etcd client and lock.
+// With MaxConcurrent (more than 1), the lock is a semaphore that can be held by MaxConcurrent nodes at the same time.
+// Username and Password are used for authentication, and TLSCA, TLSCert and TLSKey for (mutual) TLS.
+// With AutoSyncInterval, the endpoints are periodically updated with the members of the etcd cluster.
+// Prefix is the prefix of all keys (locks and status) in etcd, StatusKeyTemplate is the template of the key where the
+// status of a running job is published, and HeartbeatInterval is the interval of updating the status.
 type Config struct {
-	Endpoints   []string `yaml:"endpoints"`
-	LockKey     string   `yaml:"lockKey"`
-	LockTimeout string   `yaml:"lockTimeout"`
+	Endpoints         []string `yaml:"endpoints"`
+	LockKey           string   `yaml:"lockKey"`
+	LockTimeout       string   `yaml:"lockTimeout"`
+	MaxConcurrent     int      `yaml:"maxConcurrent,omitempty"`
+	Username          string   `yaml:"username,omitempty"`
+	Password          string   `yaml:"password,omitempty"`
+	TLSCA             string   `yaml:"tlsCA,omitempty"`
+	TLSCert           string   `yaml:"tlsCert,omitempty"`
+	TLSKey            string   `yaml:"tlsKey,omitempty"`
+	DialTimeout       string   `yaml:"dialTimeout,omitempty"`
+	AutoSyncInterval  string   `yaml:"autoSyncInterval,omitempty"`
+	Prefix            string   `yaml:"prefix,omitempty"`
+	StatusKeyTemplate string   `yaml:"statusKeyTemplate,omitempty"`
+	HeartbeatInterval string   `yaml:"heartbeatInterval,omitempty"`
+}
+
+const (
+	defaultPrefix            = "/pgquartz"
+	defaultHeartbeatInterval = 10 * time.Second
+
+	statusKeyPrefix  = "${prefix}"
+	statusKeyJob     = "${job}"
+	statusKeyRunID   = "${runId}"
+	defaultStatusKey = statusKeyPrefix + "/status/" + statusKeyJob + "/" + statusKeyRunID
+)
+
+// Verify returns all issues with the etcd config
+func (ec Config) Verify() (errs []error) {
+	if ec.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("invalid etcdConfig maxConcurrent %d", ec.MaxConcurrent))
+	}
+	if (ec.Username == "") != (ec.Password == "") {
+		errs = append(errs, fmt.Errorf("etcdConfig should have both a username and a password (or neither)"))
+	}
+	if (ec.TLSCert == "") != (ec.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("etcdConfig should have both a tlsCert and a tlsKey (or neither)"))
+	}
+	if _, err := ec.ClientConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ec.GetHeartbeatInterval(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := ec.verifyStatusKey(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func parseDuration(name string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid etcdConfig %s %s: %s", name, value, err.Error())
+	}
+	return duration, nil
+}
+
+// TLSConfig returns the TLS config for the client, or nil when TLS is not configured
+func (ec Config) TLSConfig() (*tls.Config, error) {
+	if ec.TLSCA == "" && ec.TLSCert == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ec.TLSCA != "" {
+		pem, err := os.ReadFile(ec.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in etcdConfig tlsCA %s", ec.TLSCA)
+		}
+	}
+	if ec.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(ec.TLSCert, ec.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// ClientConfig returns the config for the etcd client
+func (ec Config) ClientConfig() (config clientv3.Config, err error) {
+	config = clientv3.Config{
+		Endpoints: ec.Endpoints,
+		Username:  ec.Username,
+		Password:  ec.Password,
+	}
+	if config.DialTimeout, err = parseDuration("dialTimeout", ec.DialTimeout); err != nil {
+		return config, err
+	}
+	if config.AutoSyncInterval, err = parseDuration("autoSyncInterval", ec.AutoSyncInterval); err != nil {
+		return config, err
+	}
+	if config.TLS, err = ec.TLSConfig(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// GetPrefix returns the prefix of all keys in etcd (without a trailing slash), which defaults to /pgquartz
+func (ec Config) GetPrefix() string {
+	if ec.Prefix == "" {
+		return defaultPrefix
+	}
+	return strings.TrimRight(ec.Prefix, "/")
+}
+
+// LockPrefix returns the prefix of the mutex (or semaphore) keys of the lock (<prefix>/<lockKey>/)
+func (ec Config) LockPrefix() string {
+	return fmt.Sprintf("%s/%s/", ec.GetPrefix(), ec.LockKey)
+}
+
+// GetStatusKeyTemplate returns the template of the status keys, which defaults to ${prefix}/status/${job}/${runId}
+func (ec Config) GetStatusKeyTemplate() string {
+	if ec.StatusKeyTemplate == "" {
+		return defaultStatusKey
+	}
+	return ec.StatusKeyTemplate
+}
+
+// verifyStatusKey returns an error when the status key template cannot tell the status of a job apart from the status
+// of other jobs (and runs)
+func (ec Config) verifyStatusKey() error {
+	template := ec.GetStatusKeyTemplate()
+	job := strings.Index(template, statusKeyJob+"/")
+	if strings.Count(template, statusKeyJob) != 1 || strings.Count(template, statusKeyRunID) != 1 || job < 0 ||
+		!strings.HasSuffix(template, "/"+statusKeyRunID) || job > strings.Index(template, statusKeyRunID) {
+		return fmt.Errorf("invalid etcdConfig statusKeyTemplate %s (should have %s/, and end with /%s)", template,
+			statusKeyJob, statusKeyRunID)
+	}
+	return nil
+}
+
+// statusKeyParts returns the parts of the status key template (with the prefix expanded) before ${job}, and between
+// ${job} and ${runId}
+func (ec Config) statusKeyParts() (beforeJob string, beforeRunID string) {
+	template := strings.ReplaceAll(ec.GetStatusKeyTemplate(), statusKeyPrefix, ec.GetPrefix())
+	beforeJob, afterJob, _ := strings.Cut(template, statusKeyJob)
+	beforeRunID, _, _ = strings.Cut(afterJob, statusKeyRunID)
+	return beforeJob, beforeRunID
+}
+
+// StatusPrefix returns the prefix of the status keys of all runs of a job (<prefix>/status/<job>/ by default),
+// or of all jobs when job is empty (<prefix>/status/ by default)
+func (ec Config) StatusPrefix(job string) string {
+	beforeJob, beforeRunID := ec.statusKeyParts()
+	if job == "" {
+		return beforeJob
+	}
+	return beforeJob + job + beforeRunID
+}
+
+// StatusKey returns the key where the status of a run of a job is published (<prefix>/status/<job>/<runId> by
+// default). Every run has its own key, since with MaxConcurrent multiple runs can hold the lock at the same time.
+func (ec Config) StatusKey(job string, runID string) string {
+	return ec.StatusPrefix(job) + runID
+}
+
+// isStatusKey returns true when key is the status key of a run of a job (see StatusKey)
+func (ec Config) isStatusKey(key string) bool {
+	beforeJob, beforeRunID := ec.statusKeyParts()
+	if !strings.HasPrefix(key, beforeJob) {
+		return false
+	}
+	job, runID, found := strings.Cut(strings.TrimPrefix(key, beforeJob), beforeRunID)
+	return found && job != "" && runID != "" && !strings.Contains(job, "/") && !strings.Contains(runID, "/")
+}
+
+// VerifyLockKey returns an error when a lock with the key would contain the status keys of the job (or of all jobs),
+// or would be part of them
+func (ec Config) VerifyLockKey(key string, job string) error {
+	lockPrefix := fmt.Sprintf("%s/%s/", ec.GetPrefix(), key)
+	nested := func(prefix string) bool {
+		return strings.HasPrefix(lockPrefix, prefix) || strings.HasPrefix(prefix, lockPrefix)
+	}
+	if statusPrefix := ec.StatusPrefix(job); nested(statusPrefix) {
+		return fmt.Errorf("lock key %s conflicts with the status keys of job %s in etcd (%s), see etcdConfig "+
+			"statusKeyTemplate", key, job, statusPrefix)
+	} else if statusPrefix = ec.StatusPrefix(""); statusPrefix != ec.GetPrefix()+"/" && nested(statusPrefix) {
+		return fmt.Errorf("lock key %s conflicts with the status keys of all jobs in etcd (%s), see etcdConfig "+
+			"statusKeyTemplate", key, statusPrefix)
+	}
+	return nil
+}
+
+// GetHeartbeatInterval returns the interval of updating the status of a running job, which defaults to 10s
+func (ec Config) GetHeartbeatInterval() (time.Duration, error) {
+	interval, err := parseDuration("heartbeatInterval", ec.HeartbeatInterval)
+	if err != nil {
+		return 0, err
+	} else if interval <= 0 {
+		return defaultHeartbeatInterval, nil
+	}
+	return interval, nil
 }
 
 func (ec *Config) SetDefaults() {
@@ -0,0 +1,140 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self signed certificate and its key, and returns the paths
+func writeCert(t *testing.T) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pgquartz"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestConfig_Verify(t *testing.T) {
+	assert.Empty(t, Config{}.Verify())
+	assert.Empty(t, Config{MaxConcurrent: 2}.Verify())
+	assert.Len(t, Config{MaxConcurrent: -1}.Verify(), 1)
+	assert.Len(t, Config{Username: "pgquartz"}.Verify(), 1)
+	assert.Len(t, Config{TLSCert: "cert.pem"}.Verify(), 2, "without a key, the cert cannot be loaded either")
+	assert.Len(t, Config{DialTimeout: "5 seconds"}.Verify(), 1)
+}
+
+func TestConfig_ClientConfig(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+	config := Config{
+		Endpoints:        []string{"server1:2379"},
+		Username:         "pgquartz",
+		Password:         "secret",
+		TLSCA:            certFile,
+		TLSCert:          certFile,
+		TLSKey:           keyFile,
+		DialTimeout:      "5s",
+		AutoSyncInterval: "1m",
+	}
+	assert.Empty(t, config.Verify())
+	clientConfig, err := config.ClientConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"server1:2379"}, clientConfig.Endpoints)
+	assert.Equal(t, "secret", clientConfig.Password)
+	assert.Equal(t, 5*time.Second, clientConfig.DialTimeout)
+	assert.Equal(t, time.Minute, clientConfig.AutoSyncInterval)
+	assert.NotNil(t, clientConfig.TLS.RootCAs)
+	assert.Len(t, clientConfig.TLS.Certificates, 1)
+
+	clientConfig, err = Config{}.ClientConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, clientConfig.TLS, "without tls config, the client should not use tls")
+
+	_, err = Config{TLSCA: keyFile}.ClientConfig()
+	assert.Error(t, err, "a key is not a CA")
+}
+
+func TestConfig_Keys(t *testing.T) {
+	config := Config{LockKey: "awesomeJob1"}
+	assert.Equal(t, "/pgquartz/awesomeJob1/", config.LockPrefix(), "the lock should have the same keys as before")
+	assert.Equal(t, "/pgquartz/status/job1/0123abcd", config.StatusKey("job1", "0123abcd"))
+	assert.Equal(t, "/pgquartz/status/job1/", config.StatusPrefix("job1"))
+	assert.Equal(t, "/pgquartz/status/", config.StatusPrefix(""))
+	config.Prefix = "/clusters/cluster1/"
+	assert.Equal(t, "/clusters/cluster1/awesomeJob1/", config.LockPrefix())
+	assert.Equal(t, "/clusters/cluster1/status/job1/0123abcd", config.StatusKey("job1", "0123abcd"))
+	assert.False(t, strings.HasPrefix(config.StatusKey("awesomeJob1", "0123abcd"), config.LockPrefix()),
+		"the status of a job should not be part of a lock with the same key")
+	assert.True(t, strings.HasPrefix(config.StatusKey("job1", "0123abcd"), config.StatusPrefix("job1")))
+	assert.False(t, strings.HasPrefix(config.StatusKey("job10", "0123abcd"), config.StatusPrefix("job1")),
+		"the status of a job should not be read as the status of another job")
+
+	assert.True(t, config.isStatusKey(config.StatusKey("job1", "0123abcd")))
+	assert.False(t, config.isStatusKey(config.LockPrefix()+"694d7e5a"))
+
+	config = Config{}
+	assert.NoError(t, config.VerifyLockKey("awesomeJob1", "awesomeJob1"))
+	assert.NoError(t, config.VerifyLockKey("statuses", "job1"))
+	assert.Error(t, config.VerifyLockKey("status", "job1"), "a lock on the status keys would wait for all running jobs")
+	assert.Error(t, config.VerifyLockKey("status/job1", "job1"))
+}
+
+func TestConfig_StatusKeyTemplate(t *testing.T) {
+	config := Config{StatusKeyTemplate: "${prefix}/${job}/status/${runId}"}
+	assert.Empty(t, config.Verify())
+	assert.Equal(t, "/pgquartz/job1/status/0123abcd", config.StatusKey("job1", "0123abcd"))
+	assert.Equal(t, "/pgquartz/job1/status/", config.StatusPrefix("job1"))
+	assert.Equal(t, "/pgquartz/", config.StatusPrefix(""))
+	assert.True(t, config.isStatusKey("/pgquartz/job1/status/0123abcd"))
+	assert.False(t, config.isStatusKey("/pgquartz/job1/694d7e5a"), "lock keys should not be read as status")
+
+	assert.NoError(t, config.VerifyLockKey("status", "job1"), "status is not reserved with this template")
+	assert.NoError(t, config.VerifyLockKey("shared", "job1"))
+	assert.Error(t, config.VerifyLockKey("job1", "job1"),
+		"the lock of a job should not contain the status of the job")
+	assert.Error(t, config.VerifyLockKey("job1/status/x", "job1"))
+
+	for _, template := range []string{
+		"${prefix}/status/${job}",
+		"${prefix}/status/${runId}/${job}",
+		"${prefix}/${job}-status/${runId}-${runId}",
+		"${prefix}/status/job${job}x${runId}",
+	} {
+		assert.Len(t, Config{StatusKeyTemplate: template}.Verify(), 1, template)
+	}
+}
+
+func TestConfig_GetHeartbeatInterval(t *testing.T) {
+	interval, err := Config{}.GetHeartbeatInterval()
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, interval)
+	interval, err = Config{HeartbeatInterval: "1m"}.GetHeartbeatInterval()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, interval)
+	assert.Len(t, Config{HeartbeatInterval: "often"}.Verify(), 1)
+}
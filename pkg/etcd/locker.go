@@ -2,77 +2,205 @@ package etcd
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mannemsolutions/PgQuartz/pkg/holder"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
+// ErrLocked is returned by Lock when the lock is held by someone else, and the locker should not wait for it
+var ErrLocked = errors.New("already locked")
+
+// mutex is implemented by concurrency.Mutex and Semaphore
+type mutex interface {
+	Lock(ctx context.Context) error
+	TryLock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+	Key() string
+}
+
+// Locker locks a key in etcd (with a mutex, or with a Semaphore when MaxConcurrent is more than 1).
+// The lock is held by a session (with a lease), and when the session is lost (e.a. the lease expires during a
+// network partition), the lock is lost as well, and lost is closed.
+// When wait is false, Lock does not wait for a lock that is held by someone else, but returns ErrLocked.
+// While the lock is held, the status of the job can be published with the lease of the session (see PublishStatus).
 type Locker struct {
 	config     Config
+	wait       bool
 	cli        *clientv3.Client
 	session    *concurrency.Session
-	mutex      *concurrency.Mutex
+	mutex      mutex
 	context    context.Context
 	cancelFunc context.CancelFunc
+	lost       chan struct{}
+	closing    chan struct{}
+	heartbeats sync.WaitGroup
 }
 
-func NewEtcdLocker(config Config) Locker {
+func NewEtcdLocker(config Config, wait bool) *Locker {
 	config.SetDefaults()
-	return Locker{
+	return &Locker{
 		config: config,
+		wait:   wait,
 	}
 }
 
-func (el *Locker) Lock() {
+func (el *Locker) Lock() (err error) {
 	if el.config.LockKey == "" {
 		log.Debug("lockKey not set")
-		return
+		return nil
 	}
-	var err error
 	log.Debug("starting etcd client")
-	el.cli, err = clientv3.New(clientv3.Config{Endpoints: el.config.Endpoints})
+	clientConfig, err := el.config.ClientConfig()
+	if err != nil {
+		return err
+	}
+	el.cli, err = clientv3.New(clientConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	log.Debug("starting etcd session")
 	// create a sessions to acquire a lock
 	el.session, err = concurrency.NewSession(el.cli)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	prefix := el.config.LockPrefix()
+	if el.config.MaxConcurrent > 1 {
+		log.Debugf("getting semaphore %s (max %d)", prefix, el.config.MaxConcurrent)
+		el.mutex = NewSemaphore(el.session, prefix, el.config.MaxConcurrent)
+	} else {
+		log.Debugf("getting mutex %s", prefix)
+		el.mutex = concurrency.NewMutex(el.session, prefix)
 	}
-	log.Debugf("getting mutex /pgquartz/%s/", el.config.LockKey)
-	el.mutex = concurrency.NewMutex(el.session, fmt.Sprintf("/pgquartz/%s/", el.config.LockKey))
 	// acquire lock, or wait to have it, but cancel wait after lockDuration
 	el.context, el.cancelFunc = context.WithCancel(ctx)
 	if lockDuration, err := time.ParseDuration(el.config.LockTimeout); err != nil {
-		log.Fatal(err)
+		return err
 	} else {
 		// We use AfterFunc here, because we want the lockDuration timeout to be cancelled if we have the lock
 		// Inspired by https://stackoverflow.com/a/61455619
 		t := time.AfterFunc(lockDuration, el.cancelFunc)
-		log.Debug("locking mutex")
-		if err := el.mutex.Lock(el.context); err != nil {
-			log.Fatal(err)
+		if err := el.lockMutex(prefix, lockDuration); err != nil {
+			t.Stop()
+			return err
 		}
 		// We have the lock. Let's stop the AfterFunc and not call cancelFunc anymore...
 		log.Debug("stopping timer")
 		t.Stop()
 		// Relying on jobContext from hereon
 	}
+	el.lost = make(chan struct{})
+	el.closing = make(chan struct{})
+	go el.watch(el.session, el.lost, el.closing)
+	return nil
+}
+
+// lockMutex locks the mutex (or waits for it when it is held by someone else and wait is true), and stores the metadata
+// of this process as value of the key of the mutex, so that others can see who holds the lock
+func (el *Locker) lockMutex(prefix string, timeout time.Duration) error {
+	if !el.wait {
+		log.Debug("trying to lock mutex")
+		if err := el.mutex.TryLock(el.context); errors.Is(err, concurrency.ErrLocked) {
+			return fmt.Errorf("%w: lock %s is held by %s", ErrLocked, prefix, el.holders(prefix))
+		} else if err != nil {
+			return err
+		}
+	} else {
+		if holders := el.holders(prefix); holders != "" {
+			log.Infof("lock %s is held by %s, waiting (at most %s)", prefix, holders, timeout.String())
+		}
+		log.Debug("locking mutex")
+		if err := el.mutex.Lock(el.context); err != nil {
+			return err
+		}
+	}
+	value, err := json.Marshal(holder.New())
+	if err != nil {
+		return err
+	}
+	// Updating the value does not change the create revision, which defines the order of the holders and waiters
+	if _, err = el.cli.Put(el.context, el.mutex.Key(), string(value), clientv3.WithLease(el.session.Lease())); err != nil {
+		log.Errorf("error storing holder of lock %s: %e", prefix, err)
+	}
+	return nil
+}
+
+// holders returns a description of the processes that hold the lock (or an empty string when it is not held)
+func (el *Locker) holders(prefix string) string {
+	limit := el.config.MaxConcurrent
+	if limit < 1 {
+		limit = 1
+	}
+	response, err := el.cli.Get(el.context, prefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend), clientv3.WithLimit(int64(limit)))
+	if err != nil {
+		log.Errorf("error reading holders of lock %s: %e", prefix, err)
+		return "unknown"
+	}
+	var holders []string
+	for _, kv := range response.Kvs {
+		holders = append(holders, holder.Parse(kv.Value))
+	}
+	return strings.Join(holders, ", ")
+}
+
+// watch closes lost when the session is lost, unless the session is closed by Close
+func (el *Locker) watch(session *concurrency.Session, lost chan struct{}, closing chan struct{}) {
+	select {
+	case <-closing:
+		return
+	case <-session.Done():
+		select {
+		case <-closing:
+			return
+		default:
+		}
+		log.Errorf("etcd session for lock %s was lost", el.config.LockPrefix())
+		close(lost)
+	}
+}
+
+// Lost returns a channel that is closed when the lock is lost after it was acquired
+func (el *Locker) Lost() <-chan struct{} {
+	return el.lost
+}
+
+func (el *Locker) isLost() bool {
+	if el.lost == nil {
+		return false
+	}
+	select {
+	case <-el.lost:
+		return true
+	default:
+		return false
+	}
 }
 
 func (el *Locker) UnLock() {
 	if el.mutex != nil {
-		if err := el.mutex.Unlock(ctx); err != nil {
-			log.Fatal(err)
+		if el.isLost() {
+			log.Debug("lock was lost, not unlocking")
+		} else if err := el.mutex.Unlock(ctx); err != nil {
+			log.Errorf("error unlocking %s: %e", el.config.LockPrefix(), err)
 		}
 		el.mutex = nil
 	}
 }
 
 func (el *Locker) Close() {
+	if el.closing != nil {
+		close(el.closing)
+		el.closing = nil
+	}
+	el.heartbeats.Wait()
 	log.Debug("unlocking")
 	el.UnLock()
 	log.Debug("cancelling context")
@@ -0,0 +1,16 @@
+package etcd
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	InitLogger(logger.Sugar())
+	exitcode := m.Run()
+	_ = log.Sync()
+	os.Exit(exitcode)
+}
@@ -0,0 +1,122 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// Semaphore is a distributed semaphore, which can be held by at most limit sessions at the same time.
+// Like concurrency.Mutex, every session creates a key (with its lease) under the prefix, and the sessions with
+// the limit oldest keys hold the semaphore. When a session is lost, the lease expires and the key is removed.
+type Semaphore struct {
+	session *concurrency.Session
+	prefix  string
+	limit   int
+	key     string
+}
+
+func NewSemaphore(session *concurrency.Session, prefix string, limit int) *Semaphore {
+	return &Semaphore{session: session, prefix: prefix, limit: limit}
+}
+
+// Key returns the key of this session (which is set by Lock)
+func (s *Semaphore) Key() string {
+	return s.key
+}
+
+// Lock waits until this session is one of the limit sessions that hold the semaphore, or until ctx is done
+func (s *Semaphore) Lock(ctx context.Context) error {
+	if err := s.create(ctx); err != nil {
+		return err
+	}
+	for {
+		acquired, revision, err := s.acquired(ctx)
+		if err != nil {
+			s.cleanup()
+			return err
+		} else if acquired {
+			return nil
+		}
+		log.Debugf("semaphore %s is held by %d sessions, waiting for one to be released", s.prefix, s.limit)
+		if err = s.waitForRelease(ctx, revision+1); err != nil {
+			s.cleanup()
+			return err
+		}
+	}
+}
+
+// TryLock acquires the semaphore when it is available, and returns concurrency.ErrLocked (like concurrency.Mutex)
+// when it is held by limit other sessions
+func (s *Semaphore) TryLock(ctx context.Context) error {
+	if err := s.create(ctx); err != nil {
+		return err
+	}
+	acquired, _, err := s.acquired(ctx)
+	if err != nil || !acquired {
+		s.cleanup()
+		if err == nil {
+			err = concurrency.ErrLocked
+		}
+		return err
+	}
+	return nil
+}
+
+// create creates the key of this session under the prefix
+func (s *Semaphore) create(ctx context.Context) error {
+	s.key = fmt.Sprintf("%s%x", s.prefix, s.session.Lease())
+	create := clientv3.Compare(clientv3.CreateRevision(s.key), "=", 0)
+	put := clientv3.OpPut(s.key, "", clientv3.WithLease(s.session.Lease()))
+	_, err := s.session.Client().Txn(ctx).If(create).Then(put).Commit()
+	return err
+}
+
+// acquired returns true when the key of this session is one of the limit oldest keys (and the revision it was read at)
+func (s *Semaphore) acquired(ctx context.Context) (bool, int64, error) {
+	holders, err := s.session.Client().Get(ctx, s.prefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend), clientv3.WithLimit(int64(s.limit)))
+	if err != nil {
+		return false, 0, err
+	}
+	for _, kv := range holders.Kvs {
+		if string(kv.Key) == s.key {
+			return true, holders.Header.Revision, nil
+		}
+	}
+	return false, holders.Header.Revision, nil
+}
+
+// waitForRelease waits until a key under the prefix is deleted (from revision on)
+func (s *Semaphore) waitForRelease(ctx context.Context, revision int64) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for response := range s.session.Client().Watch(watchCtx, s.prefix, clientv3.WithPrefix(),
+		clientv3.WithRev(revision), clientv3.WithFilterPut()) {
+		if err := response.Err(); err != nil {
+			return err
+		} else if len(response.Events) > 0 {
+			return nil
+		}
+	}
+	// The watch channel is closed when ctx is done
+	return ctx.Err()
+}
+
+// cleanup removes the key after acquiring failed, so that it does not take a slot of the semaphore
+func (s *Semaphore) cleanup() {
+	if _, err := s.session.Client().Delete(s.session.Client().Ctx(), s.key); err != nil {
+		log.Errorf("error removing semaphore key %s: %e", s.key, err)
+	}
+}
+
+// Unlock releases the semaphore, so that another session can acquire it
+func (s *Semaphore) Unlock(ctx context.Context) error {
+	if _, err := s.session.Client().Delete(ctx, s.key); err != nil {
+		return err
+	}
+	s.key = ""
+	return nil
+}
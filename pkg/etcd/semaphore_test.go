@@ -0,0 +1,351 @@
+package etcd
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"google.golang.org/grpc"
+)
+
+// fakeEtcd is an in memory etcd server, which implements (the parts of) the KV, Watch and Lease services that a
+// Semaphore (and a concurrency.Session) use, so that Semaphores can be tested with a real etcd client.
+type fakeEtcd struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedWatchServer
+	pb.UnimplementedLeaseServer
+	mutex    sync.Mutex
+	revision int64
+	leases   int64
+	kvs      map[string]*mvccpb.KeyValue
+	events   []*mvccpb.Event
+	// changed is closed (and replaced) on every change, to wake up all watchers
+	changed chan struct{}
+}
+
+// newFakeEtcd starts a fakeEtcd, and returns a client that is connected to it
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *clientv3.Client) {
+	f := &fakeEtcd{revision: 1, kvs: make(map[string]*mvccpb.KeyValue), changed: make(chan struct{})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterKVServer(server, f)
+	pb.RegisterWatchServer(server, f)
+	pb.RegisterLeaseServer(server, f)
+	go func() { _ = server.Serve(listener) }()
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{listener.Addr().String()},
+		DialTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+		server.Stop()
+	})
+	return f, client
+}
+
+func (f *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: f.revision}
+}
+
+// inRange returns true when key is in the range of an etcd request (where an empty end is a single key)
+func inRange(key []byte, start []byte, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return string(key) == string(start)
+	case string(end) == "\x00":
+		return string(key) >= string(start)
+	}
+	return string(key) >= string(start) && string(key) < string(end)
+}
+
+// change applies an event (with the next revision), and wakes up all watchers
+func (f *fakeEtcd) change(eventType mvccpb.Event_EventType, kv *mvccpb.KeyValue) {
+	f.revision++
+	kv.ModRevision = f.revision
+	if eventType == mvccpb.PUT {
+		if existing, exists := f.kvs[string(kv.Key)]; exists {
+			kv.CreateRevision = existing.CreateRevision
+		} else {
+			kv.CreateRevision = f.revision
+		}
+		f.kvs[string(kv.Key)] = kv
+	} else {
+		delete(f.kvs, string(kv.Key))
+	}
+	f.events = append(f.events, &mvccpb.Event{Type: eventType, Kv: kv})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeEtcd) deleteRange(start []byte, end []byte) (deleted int64) {
+	for key := range f.kvs {
+		if inRange([]byte(key), start, end) {
+			f.change(mvccpb.DELETE, &mvccpb.KeyValue{Key: []byte(key)})
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (f *fakeEtcd) Range(_ context.Context, request *pb.RangeRequest) (*pb.RangeResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var kvs []*mvccpb.KeyValue
+	for _, kv := range f.kvs {
+		if inRange(kv.Key, request.Key, request.RangeEnd) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		if request.SortTarget == pb.RangeRequest_CREATE {
+			return kvs[i].CreateRevision < kvs[j].CreateRevision
+		}
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
+	count := int64(len(kvs))
+	if request.Limit > 0 && int64(len(kvs)) > request.Limit {
+		kvs = kvs[:request.Limit]
+	}
+	return &pb.RangeResponse{Header: f.header(), Kvs: kvs, Count: count, More: count > int64(len(kvs))}, nil
+}
+
+func (f *fakeEtcd) DeleteRange(_ context.Context, request *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	deleted := f.deleteRange(request.Key, request.RangeEnd)
+	return &pb.DeleteRangeResponse{Header: f.header(), Deleted: deleted}, nil
+}
+
+// Txn only supports comparing create revisions, and put and delete operations
+func (f *fakeEtcd) Txn(_ context.Context, request *pb.TxnRequest) (*pb.TxnResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	succeeded := true
+	for _, compare := range request.Compare {
+		var createRevision int64
+		if kv, exists := f.kvs[string(compare.Key)]; exists {
+			createRevision = kv.CreateRevision
+		}
+		if compare.Target != pb.Compare_CREATE || compare.Result != pb.Compare_EQUAL {
+			panic("fakeEtcd only supports comparing create revisions for equality")
+		} else if createRevision != compare.GetCreateRevision() {
+			succeeded = false
+		}
+	}
+	ops := request.Success
+	if !succeeded {
+		ops = request.Failure
+	}
+	response := &pb.TxnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		if put := op.GetRequestPut(); put != nil {
+			f.change(mvccpb.PUT, &mvccpb.KeyValue{Key: put.Key, Value: put.Value, Lease: put.Lease})
+			response.Responses = append(response.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponsePut{ResponsePut: &pb.PutResponse{Header: f.header()}}})
+		} else if deleteRange := op.GetRequestDeleteRange(); deleteRange != nil {
+			deleted := f.deleteRange(deleteRange.Key, deleteRange.RangeEnd)
+			response.Responses = append(response.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseDeleteRange{
+					ResponseDeleteRange: &pb.DeleteRangeResponse{Header: f.header(), Deleted: deleted}}})
+		} else {
+			panic("fakeEtcd only supports put and delete operations in transactions")
+		}
+	}
+	response.Header = f.header()
+	return response, nil
+}
+
+func (f *fakeEtcd) LeaseGrant(_ context.Context, request *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.leases++
+	return &pb.LeaseGrantResponse{Header: f.header(), ID: f.leases, TTL: request.TTL}, nil
+}
+
+// LeaseRevoke removes all keys with the lease (leases never expire otherwise)
+func (f *fakeEtcd) LeaseRevoke(_ context.Context, request *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for key, kv := range f.kvs {
+		if kv.Lease == request.ID {
+			f.deleteRange([]byte(key), nil)
+		}
+	}
+	return &pb.LeaseRevokeResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		request, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		f.mutex.Lock()
+		response := &pb.LeaseKeepAliveResponse{Header: f.header(), ID: request.ID, TTL: 60}
+		f.mutex.Unlock()
+		if err = stream.Send(response); err != nil {
+			return err
+		}
+	}
+}
+
+// Watch handles all watches (which the client multiplexes over one stream) with a goroutine per watch
+func (f *fakeEtcd) Watch(stream pb.Watch_WatchServer) error {
+	var sendLock sync.Mutex
+	send := func(response *pb.WatchResponse) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		return stream.Send(response)
+	}
+	watches := make(map[int64]chan struct{})
+	defer func() {
+		for _, canceled := range watches {
+			close(canceled)
+		}
+	}()
+	for watchID := int64(1); ; {
+		request, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if create := request.GetCreateRequest(); create != nil {
+			f.mutex.Lock()
+			next := create.StartRevision
+			if next == 0 {
+				next = f.revision + 1
+			}
+			header := f.header()
+			f.mutex.Unlock()
+			canceled := make(chan struct{})
+			watches[watchID] = canceled
+			if err = send(&pb.WatchResponse{Header: header, WatchId: watchID, Created: true}); err != nil {
+				return err
+			}
+			go f.watch(stream.Context(), create, watchID, next, canceled, send)
+			watchID++
+		} else if cancel := request.GetCancelRequest(); cancel != nil {
+			if canceled, exists := watches[cancel.WatchId]; exists {
+				close(canceled)
+				delete(watches, cancel.WatchId)
+			}
+			_ = send(&pb.WatchResponse{Header: &pb.ResponseHeader{}, WatchId: cancel.WatchId, Canceled: true})
+		}
+	}
+}
+
+// watch sends all events that match a watch (from revision next on), until the watch is canceled
+func (f *fakeEtcd) watch(streamCtx context.Context, create *pb.WatchCreateRequest, watchID int64, next int64,
+	canceled chan struct{}, send func(*pb.WatchResponse) error) {
+	noPut := false
+	for _, filter := range create.Filters {
+		noPut = noPut || filter == pb.WatchCreateRequest_NOPUT
+	}
+	for {
+		f.mutex.Lock()
+		var events []*mvccpb.Event
+		for _, event := range f.events {
+			if event.Kv.ModRevision >= next && inRange(event.Kv.Key, create.Key, create.RangeEnd) &&
+				!(noPut && event.Type == mvccpb.PUT) {
+				events = append(events, event)
+			}
+		}
+		next = f.revision + 1
+		header, changed := f.header(), f.changed
+		f.mutex.Unlock()
+		if len(events) > 0 {
+			if err := send(&pb.WatchResponse{Header: header, WatchId: watchID, Events: events}); err != nil {
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-canceled:
+			return
+		case <-streamCtx.Done():
+			return
+		}
+	}
+}
+
+// newSemaphores returns a Semaphore (each with its own session) for every session, all for the same prefix and limit
+func newSemaphores(t *testing.T, client *clientv3.Client, sessions int, limit int) (semaphores []*Semaphore) {
+	for i := 0; i < sessions; i++ {
+		session, err := concurrency.NewSession(client)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		semaphores = append(semaphores, NewSemaphore(session, "/pgquartz/job1/", limit))
+	}
+	return semaphores
+}
+
+// keys returns all keys under the prefix of the semaphores
+func keys(t *testing.T, client *clientv3.Client) (keys []string) {
+	response, err := client.Get(context.Background(), "/pgquartz/job1/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	for _, kv := range response.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
+
+func TestSemaphore_Lock(t *testing.T) {
+	_, client := newFakeEtcd(t)
+	testCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	semaphores := newSemaphores(t, client, 3, 2)
+	for _, s := range semaphores[:2] {
+		assert.NoError(t, s.Lock(testCtx), "the first %d sessions should acquire the semaphore", 2)
+	}
+
+	locked := make(chan error)
+	go func() { locked <- semaphores[2].Lock(testCtx) }()
+	select {
+	case err := <-locked:
+		t.Fatalf("the semaphore should not be acquired while held by 2 sessions (err: %v)", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Len(t, keys(t, client), 3, "a waiting session should have its own key")
+
+	assert.NoError(t, semaphores[0].Unlock(testCtx))
+	select {
+	case err := <-locked:
+		assert.NoError(t, err, "a waiting session should acquire the semaphore when another session unlocks")
+	case <-testCtx.Done():
+		t.Fatal("the semaphore was not acquired after another session unlocked")
+	}
+	assert.ElementsMatch(t, []string{semaphores[1].Key(), semaphores[2].Key()}, keys(t, client))
+}
+
+func TestSemaphore_LockTimeout(t *testing.T) {
+	_, client := newFakeEtcd(t)
+	semaphores := newSemaphores(t, client, 2, 1)
+	assert.NoError(t, semaphores[0].Lock(context.Background()))
+	lockCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, semaphores[1].Lock(lockCtx), context.DeadlineExceeded)
+	assert.Equal(t, []string{semaphores[0].Key()}, keys(t, client),
+		"the key of a session that stopped waiting should be removed")
+}
+
+func TestSemaphore_TryLock(t *testing.T) {
+	_, client := newFakeEtcd(t)
+	semaphores := newSemaphores(t, client, 3, 2)
+	for _, s := range semaphores[:2] {
+		assert.NoError(t, s.TryLock(context.Background()))
+	}
+	assert.ErrorIs(t, semaphores[2].TryLock(context.Background()), concurrency.ErrLocked)
+	assert.ElementsMatch(t, []string{semaphores[0].Key(), semaphores[1].Key()}, keys(t, client),
+		"the key of a session that could not acquire the semaphore should be removed")
+
+	assert.NoError(t, semaphores[1].Unlock(context.Background()))
+	assert.NoError(t, semaphores[2].TryLock(context.Background()))
+}
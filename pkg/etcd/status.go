@@ -0,0 +1,133 @@
+package etcd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// readTimeout is the maximum duration of reading the status from etcd
+	readTimeout = 10 * time.Second
+)
+
+// Status is the status of a running job, which is published in etcd while the job holds the lock.
+// Steps has the state of every step (e.a. Waiting, Scheduled, Done), and Heartbeat is updated periodically.
+type Status struct {
+	Job         string            `json:"job"`
+	Host        string            `json:"host"`
+	Pid         int               `json:"pid"`
+	RunID       string            `json:"runId"`
+	StartTime   time.Time         `json:"startTime"`
+	GitRevision string            `json:"gitRevision,omitempty"`
+	Steps       map[string]string `json:"steps,omitempty"`
+	Heartbeat   time.Time         `json:"heartbeat"`
+}
+
+// NewStatus returns the status of a job that is started now by this process (with a random run id)
+func NewStatus(job string, gitRevision string) Status {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Errorf("could not determine hostname: %e", err)
+	}
+	runID := make([]byte, 8)
+	if _, err = rand.Read(runID); err != nil {
+		log.Errorf("could not generate run id: %e", err)
+	}
+	return Status{
+		Job:         job,
+		Host:        host,
+		Pid:         os.Getpid(),
+		RunID:       hex.EncodeToString(runID),
+		StartTime:   time.Now(),
+		GitRevision: gitRevision,
+	}
+}
+
+// PublishStatus publishes the status of the job under the status key of the run (with the lease of the lock session, so that it
+// is removed when the session ends). Until the locker is closed, the status is updated (by calling update) and
+// published again every heartbeatInterval.
+func (el *Locker) PublishStatus(status Status, update func(status *Status)) error {
+	if el.session == nil || el.closing == nil {
+		return fmt.Errorf("cannot publish status of job %s without holding the lock", status.Job)
+	}
+	interval, err := el.config.GetHeartbeatInterval()
+	if err != nil {
+		return err
+	}
+	key := el.config.StatusKey(status.Job, status.RunID)
+	cli, lease, closing := el.cli, el.session.Lease(), el.closing
+	publish := func() error {
+		if update != nil {
+			update(&status)
+		}
+		status.Heartbeat = time.Now()
+		value, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		_, err = cli.Put(ctx, key, string(value), clientv3.WithLease(lease))
+		return err
+	}
+	log.Debugf("publishing status at %s", key)
+	if err = publish(); err != nil {
+		return err
+	}
+	el.heartbeats.Add(1)
+	go func() {
+		defer el.heartbeats.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case <-ticker.C:
+			}
+			if err := publish(); err != nil {
+				log.Errorf("error publishing status at %s: %e", key, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// ReadStatus reads the status of all runs of a running job from etcd (more than one with MaxConcurrent), or the status
+// of all running jobs when job is empty. A job that is not running has no status.
+func ReadStatus(config Config, job string) (statuses []Status, err error) {
+	config.SetDefaults()
+	clientConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := clientv3.New(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	readCtx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	response, err := cli.Get(readCtx, config.StatusPrefix(job), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range response.Kvs {
+		if !config.isStatusKey(string(kv.Key)) {
+			// With a statusKeyTemplate that shares a prefix with locks (e.a. ${prefix}/${job}/status/${runId}), the prefix
+			// also has the keys of locks
+			continue
+		}
+		var status Status
+		if err = json.Unmarshal(kv.Value, &status); err != nil {
+			return nil, fmt.Errorf("invalid status at %s: %s", kv.Key, err.Error())
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,29 @@
+package etcd
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStatus(t *testing.T) {
+	status := NewStatus("job1", "0123abcd")
+	assert.Equal(t, "job1", status.Job)
+	assert.Equal(t, os.Getpid(), status.Pid)
+	assert.Len(t, status.RunID, 16)
+	assert.NotEqual(t, status.RunID, NewStatus("job1", "").RunID, "every run should have its own run id")
+	assert.False(t, status.StartTime.IsZero())
+
+	status.Steps = map[string]string{"step 1": "Done"}
+	out, err := json.Marshal(status)
+	assert.NoError(t, err)
+	var read Status
+	assert.NoError(t, json.Unmarshal(out, &read))
+	assert.True(t, status.StartTime.Equal(read.StartTime))
+	read.StartTime = status.StartTime
+	assert.Equal(t, status, read)
+	assert.Contains(t, string(out), `"runId":`)
+	assert.Contains(t, string(out), `"gitRevision":"0123abcd"`)
+}
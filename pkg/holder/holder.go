@@ -0,0 +1,49 @@
+// Package holder describes the process that holds a lock, which is shared by all lock backends that store it with
+// the lock (etcd and flock)
+package holder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var log *zap.SugaredLogger
+
+func InitLogger(logger *zap.SugaredLogger) {
+	log = logger
+}
+
+// Holder is the metadata of the process that holds a lock, which is stored with the lock (as value of the key of the
+// lock in etcd, or in the lock file for flock)
+type Holder struct {
+	Host      string    `json:"host"`
+	Pid       int       `json:"pid"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// New returns the metadata of this process as holder of a lock (since now)
+func New() Holder {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Errorf("could not determine hostname: %e", err)
+	}
+	return Holder{Host: host, Pid: os.Getpid(), StartTime: time.Now()}
+}
+
+// Parse returns a description of the holder in value, or unknown when value is not valid holder metadata (e.a.
+// when the lock was just acquired, and the metadata is not stored yet)
+func Parse(value []byte) string {
+	var h Holder
+	if err := json.Unmarshal(value, &h); err != nil || h.Pid == 0 {
+		return "unknown"
+	}
+	return h.String()
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("%s (pid %d, since %s)", h.Host, h.Pid, h.StartTime.Format(time.RFC3339))
+}
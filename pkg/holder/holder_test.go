@@ -0,0 +1,24 @@
+package holder
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	value, err := json.Marshal(New())
+	assert.NoError(t, err)
+	assert.Contains(t, Parse(value), "(pid "+strconv.Itoa(os.Getpid())+", since ")
+	assert.Equal(t, "unknown", Parse([]byte("")), "a lock that was just acquired has no metadata yet")
+	assert.Equal(t, "unknown", Parse(nil))
+
+	h := Holder{Host: "server1", Pid: 42, StartTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	value, err = json.Marshal(h)
+	assert.NoError(t, err)
+	assert.Equal(t, "server1 (pid 42, since 2024-01-02T03:04:05Z)", Parse(value))
+}
@@ -1,8 +1,46 @@
 package jobs
 
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
 type Alert struct {
 	AlertType string `yaml:"type"`
 	Command   string `yaml:"command"`
 }
 
 type Alerts []Alert
+
+// Send sends all alerts, and logs (but otherwise ignores) alerts that could not be sent
+func (as Alerts) Send(conns Connections, message string) {
+	for _, a := range as {
+		if err := a.Send(conns, message); err != nil {
+			log.Errorf("error while sending alert (%s): %e", a.String(), err)
+		}
+	}
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("type=%s, command='%s'", a.AlertType, a.Command)
+}
+
+// Send runs the alert command with message as argument.
+// Like with commands, type is either shell (the message is set as PGQ_INSTANCE_MESSAGE),
+// or the name of a connection (the message can be used as :message).
+func (a Alert) Send(conns Connections, message string) (err error) {
+	log.Infof("Sending alert: %s", a.String())
+	args := InstanceArguments{"message": message}
+	if a.AlertType == "" || a.AlertType == "shell" {
+		exAlert := exec.Command("/bin/bash", "-c", a.Command) // #nosec
+		exAlert.Env = args.AsEnv()
+		if out, err := exAlert.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s (output: %s)", err.Error(), string(out))
+		}
+		return nil
+	}
+	_, err = conns.Execute(a.AlertType, "", a.Command, false, pg.QueryOptions{}, SqlStates{}, args)
+	return err
+}
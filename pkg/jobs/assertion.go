@@ -0,0 +1,360 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	assertionSourceStdOut = "stdout"
+	assertionSourceStdErr = "stderr"
+)
+
+var (
+	comparisonRegExp = regexp.MustCompile(`^\s*(==|!=|>=|<=|>|<)\s*(\S.*?)\s*$`)
+	betweenRegExp    = regexp.MustCompile(`^\s*between\s+(\S+)\s+and\s+(\S+)\s*$`)
+	jsonPathRegExp   = regexp.MustCompile(`^(?:\.([^.\[\]]+)|\[(\d+)\]|\["([^"]*)"\])`)
+)
+
+// Comparison is a parsed comparison expression like `> 1000`, `between 1 and 10`, `== ok` or just `ok`
+type Comparison struct {
+	Operator string
+	Operands []string
+}
+
+func ParseComparison(expression string) (Comparison, error) {
+	if m := betweenRegExp.FindStringSubmatch(expression); m != nil {
+		c := Comparison{Operator: "between", Operands: m[1:]}
+		for _, operand := range c.Operands {
+			if _, err := strconv.ParseFloat(operand, 64); err != nil {
+				return c, fmt.Errorf("comparison '%s' requires numeric operands", expression)
+			}
+		}
+		return c, nil
+	}
+	if m := comparisonRegExp.FindStringSubmatch(expression); m != nil {
+		c := Comparison{Operator: m[1], Operands: m[2:]}
+		if c.Operator == "==" || c.Operator == "!=" {
+			return c, nil
+		}
+		if _, err := strconv.ParseFloat(c.Operands[0], 64); err != nil {
+			return c, fmt.Errorf("comparison '%s' requires a numeric operand", expression)
+		}
+		return c, nil
+	}
+	return Comparison{Operator: "==", Operands: []string{expression}}, nil
+}
+
+func (c Comparison) String() string {
+	if c.Operator == "between" {
+		return fmt.Sprintf("between %s and %s", c.Operands[0], c.Operands[1])
+	}
+	return fmt.Sprintf("%s %s", c.Operator, c.Operands[0])
+}
+
+// Compare returns true if actual matches the comparison.
+// Comparisons with == and != are numeric when both sides are numeric, and string comparisons otherwise.
+func (c Comparison) Compare(actual string) (bool, error) {
+	var operands []float64
+	for _, operand := range c.Operands {
+		if f, err := strconv.ParseFloat(operand, 64); err == nil {
+			operands = append(operands, f)
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(actual), 64)
+	numeric := err == nil && len(operands) == len(c.Operands)
+	switch c.Operator {
+	case "==":
+		if numeric {
+			return value == operands[0], nil
+		}
+		return actual == c.Operands[0], nil
+	case "!=":
+		if numeric {
+			return value != operands[0], nil
+		}
+		return actual != c.Operands[0], nil
+	}
+	if !numeric {
+		return false, fmt.Errorf("value '%s' is not numeric", actual)
+	}
+	switch c.Operator {
+	case ">":
+		return value > operands[0], nil
+	case ">=":
+		return value >= operands[0], nil
+	case "<":
+		return value < operands[0], nil
+	case "<=":
+		return value <= operands[0], nil
+	case "between":
+		return value >= operands[0] && value <= operands[1], nil
+	}
+	return false, fmt.Errorf("unknown operator %s", c.Operator)
+}
+
+// Assertion is one assertion on the output of a check.
+// Exactly one of RegExp, NotRegExp, Line, Lines, Rows, Column, Capture or JSONPath should be set.
+// Column, Capture and JSONPath are compared with Value (JSONPath without Value only asserts that the path exists).
+type Assertion struct {
+	Name      string `yaml:"name,omitempty"`
+	Source    string `yaml:"source,omitempty"`
+	RegExp    string `yaml:"regexp,omitempty"`
+	NotRegExp string `yaml:"notRegexp,omitempty"`
+	Line      string `yaml:"line,omitempty"`
+	Lines     string `yaml:"lines,omitempty"`
+	Rows      string `yaml:"rows,omitempty"`
+	Column    string `yaml:"column,omitempty"`
+	Capture   string `yaml:"capture,omitempty"`
+	JSONPath  string `yaml:"jsonPath,omitempty"`
+	Value     string `yaml:"value,omitempty"`
+}
+
+func (a Assertion) String() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	var assertion string
+	switch {
+	case a.RegExp != "":
+		assertion = fmt.Sprintf("regexp '%s'", a.RegExp)
+	case a.NotRegExp != "":
+		assertion = fmt.Sprintf("notRegexp '%s'", a.NotRegExp)
+	case a.Line != "":
+		assertion = fmt.Sprintf("line '%s'", a.Line)
+	case a.Lines != "":
+		assertion = fmt.Sprintf("lines %s", a.Lines)
+	case a.Rows != "":
+		return fmt.Sprintf("rows %s", a.Rows)
+	case a.Column != "":
+		return fmt.Sprintf("column %s %s", a.Column, a.Value)
+	case a.Capture != "":
+		assertion = fmt.Sprintf("capture '%s' %s", a.Capture, a.Value)
+	case a.JSONPath != "":
+		assertion = strings.TrimSpace(fmt.Sprintf("jsonPath %s %s", a.JSONPath, a.Value))
+	}
+	return fmt.Sprintf("%s in %s", assertion, a.source())
+}
+
+func (a Assertion) source() string {
+	if a.Source == "" {
+		return assertionSourceStdOut
+	}
+	return a.Source
+}
+
+func (a Assertion) kinds() (kinds []string) {
+	for kind, value := range map[string]string{
+		"regexp":    a.RegExp,
+		"notRegexp": a.NotRegExp,
+		"line":      a.Line,
+		"lines":     a.Lines,
+		"rows":      a.Rows,
+		"column":    a.Column,
+		"capture":   a.Capture,
+		"jsonPath":  a.JSONPath,
+	} {
+		if value != "" {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// Verify checks the assertion definition, where isQuery defines if the check runs against a database connection
+func (a Assertion) Verify(isQuery bool) (errs []error) {
+	if kinds := a.kinds(); len(kinds) != 1 {
+		errs = append(errs, fmt.Errorf("assertion %s should have exactly one of regexp, notRegexp, line, lines, rows, "+
+			"column, capture or jsonPath set (found %d)", a.String(), len(kinds)))
+	}
+	if a.source() != assertionSourceStdOut && a.source() != assertionSourceStdErr {
+		errs = append(errs, fmt.Errorf("assertion %s has an invalid source %s", a.String(), a.Source))
+	}
+	for _, exp := range []string{a.RegExp, a.NotRegExp, a.Capture} {
+		if _, err := regexp.Compile(exp); err != nil {
+			errs = append(errs, fmt.Errorf("assertion %s has an invalid regular expression: %w", a.String(), err))
+		}
+	}
+	if re, err := regexp.Compile(a.Capture); err == nil && a.Capture != "" && re.NumSubexp() < 1 {
+		errs = append(errs, fmt.Errorf("assertion %s should have a capture group", a.String()))
+	}
+	if (a.Rows != "" || a.Column != "") && !isQuery {
+		errs = append(errs, fmt.Errorf("assertion %s can only be used on checks against a connection", a.String()))
+	}
+	if (a.Column != "" || a.Capture != "") && a.Value == "" {
+		errs = append(errs, fmt.Errorf("assertion %s requires a value to compare with", a.String()))
+	}
+	if a.JSONPath != "" {
+		if _, err := parseJSONPath(a.JSONPath); err != nil {
+			errs = append(errs, fmt.Errorf("assertion %s: %w", a.String(), err))
+		}
+	}
+	for _, expression := range []string{a.Lines, a.Rows, a.Value} {
+		if expression == "" {
+			continue
+		}
+		if _, err := ParseComparison(expression); err != nil {
+			errs = append(errs, fmt.Errorf("assertion %s: %w", a.String(), err))
+		}
+	}
+	return errs
+}
+
+func (a Assertion) compare(expression string, actual string) error {
+	if comparison, err := ParseComparison(expression); err != nil {
+		return err
+	} else if ok, err := comparison.Compare(actual); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("'%s' is not %s", actual, comparison.String())
+	}
+	return nil
+}
+
+// Evaluate returns an error when the output does not meet the assertion
+func (a Assertion) Evaluate(out RunOutput) error {
+	result := out.StdOut
+	if a.source() == assertionSourceStdErr {
+		result = out.StdErr
+	}
+	switch {
+	case a.RegExp != "":
+		if !result.RegExpContains(a.RegExp) {
+			return fmt.Errorf("no line matches")
+		}
+	case a.NotRegExp != "":
+		if result.RegExpContains(a.NotRegExp) {
+			return fmt.Errorf("a line matches")
+		}
+	case a.Line != "":
+		if !result.ContainsLine(a.Line) {
+			return fmt.Errorf("line not found")
+		}
+	case a.Lines != "":
+		numLines := len(result)
+		if numLines == 1 && result[0] == "" {
+			numLines = 0
+		}
+		return a.compare(a.Lines, strconv.Itoa(numLines))
+	case a.Rows != "":
+		return a.compare(a.Rows, strconv.Itoa(out.Rows.Count()))
+	case a.Column != "":
+		if !out.Rows.Header().Contains(a.Column) {
+			return fmt.Errorf("column %s does not exist", a.Column)
+		}
+		values := out.Rows.Column(a.Column)
+		if len(values) == 0 {
+			return fmt.Errorf("column %s has no values (no rows)", a.Column)
+		}
+		for _, value := range values {
+			if err := a.compare(a.Value, value); err != nil {
+				return err
+			}
+		}
+	case a.Capture != "":
+		m := regexp.MustCompile(a.Capture).FindStringSubmatch(result.Text())
+		if m == nil {
+			return fmt.Errorf("no match")
+		}
+		return a.compare(a.Value, m[1])
+	case a.JSONPath != "":
+		if value, err := evaluateJSONPath(a.JSONPath, result.Text()); err != nil {
+			return err
+		} else if a.Value != "" {
+			return a.compare(a.Value, value)
+		}
+	}
+	return nil
+}
+
+type Assertions []Assertion
+
+func (as Assertions) Verify(isQuery bool) (errs []error) {
+	for _, a := range as {
+		errs = append(errs, a.Verify(isQuery)...)
+	}
+	return errs
+}
+
+// Evaluate evaluates all assertions, logs the result of every assertion, and returns an error if one or more failed
+func (as Assertions) Evaluate(out RunOutput) error {
+	var failed []string
+	for _, a := range as {
+		if err := a.Evaluate(out); err != nil {
+			log.Errorf("assertion %s failed: %s", a.String(), err.Error())
+			failed = append(failed, fmt.Sprintf("%s: %s", a.String(), err.Error()))
+		} else {
+			log.Infof("assertion %s passed", a.String())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d assertion(s) failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// parseJSONPath parses a simple json path like `$.items[0].name` or `.["my key"]` into a list of keys and indexes
+func parseJSONPath(path string) (parts []interface{}, err error) {
+	remaining := strings.TrimPrefix(path, "$")
+	for remaining != "" {
+		m := jsonPathRegExp.FindStringSubmatch(remaining)
+		if m == nil {
+			return nil, fmt.Errorf("invalid json path %s at '%s'", path, remaining)
+		}
+		switch {
+		case m[1] != "":
+			parts = append(parts, m[1])
+		case m[2] != "":
+			index, _ := strconv.Atoi(m[2])
+			parts = append(parts, index)
+		default:
+			parts = append(parts, m[3])
+		}
+		remaining = remaining[len(m[0]):]
+	}
+	return parts, nil
+}
+
+// evaluateJSONPath returns the value at path in document.
+// Strings are returned as is, and other values (numbers, booleans, null, objects and arrays) as json.
+func evaluateJSONPath(path string, document string) (string, error) {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("output is not valid json: %w", err)
+	} else if _, err = decoder.Token(); err != io.EOF {
+		return "", fmt.Errorf("output is not valid json: unexpected data after the json document")
+	}
+	parts, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, part := range parts {
+		switch key := part.(type) {
+		case string:
+			if object, ok := value.(map[string]interface{}); !ok {
+				return "", fmt.Errorf("json path %s: cannot get key %s from a non-object", path, key)
+			} else if value, ok = object[key]; !ok {
+				return "", fmt.Errorf("json path %s: key %s does not exist", path, key)
+			}
+		case int:
+			if array, ok := value.([]interface{}); !ok {
+				return "", fmt.Errorf("json path %s: cannot get index %d from a non-array", path, key)
+			} else if key >= len(array) {
+				return "", fmt.Errorf("json path %s: index %d out of range", path, key)
+			} else {
+				value = array[key]
+			}
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
@@ -0,0 +1,112 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparison(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		actual     string
+		expected   bool
+	}{
+		{"> 1000", "1001", true},
+		{"> 1000", "1000", false},
+		{">= 1000", "1000", true},
+		{"< 1.5", "1.25", true},
+		{"<= 1", "2", false},
+		{"between 1 and 10", "10", true},
+		{"between 1 and 10", "11", false},
+		{"== 5", "5.0", true},
+		{"!= ok", "ok", false},
+		{"ok", "ok", true},
+	} {
+		c, err := ParseComparison(test.expression)
+		assert.NoError(t, err)
+		result, err := c.Compare(test.actual)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, result, "'%s' %s", test.actual, test.expression)
+	}
+	_, err := ParseComparison("> many")
+	assert.Error(t, err, "numeric comparisons need numeric operands")
+	c, _ := ParseComparison("> 1")
+	_, err = c.Compare("many")
+	assert.Error(t, err, "numeric comparisons need numeric values")
+}
+
+func TestAssertion_Evaluate(t *testing.T) {
+	out := RunOutput{
+		StdOut: NewResultFromString("{\"status\": \"ok\", \"items\": [{\"size\": 1200}]}\ntook 42 ms\n"),
+		StdErr: NewResultFromString(""),
+	}
+	for _, test := range []struct {
+		assertion Assertion
+		passes    bool
+	}{
+		{Assertion{RegExp: `took \d+ ms`}, true},
+		{Assertion{NotRegExp: `took \d+ ms`}, false},
+		{Assertion{Line: "took 42 ms"}, true},
+		{Assertion{Line: "took 42"}, false},
+		{Assertion{Lines: "== 2"}, true},
+		{Assertion{Lines: "== 0", Source: "stderr"}, true},
+		{Assertion{Capture: `took (\d+) ms`, Value: "between 10 and 100"}, true},
+		{Assertion{Capture: `took (\d+) ms`, Value: "< 10"}, false},
+		{Assertion{JSONPath: "$.status", Value: "ok"}, false},
+	} {
+		err := test.assertion.Evaluate(out)
+		if test.passes {
+			assert.NoError(t, err, "assertion %s should pass", test.assertion.String())
+		} else {
+			assert.Error(t, err, "assertion %s should fail", test.assertion.String())
+		}
+	}
+}
+
+func TestAssertion_Column(t *testing.T) {
+	out := RunOutput{Rows: pg.NewResult([]string{"cnt"}, pg.Row{"1"}, pg.Row{"3"})}
+	assert.NoError(t, Assertion{Column: "cnt", Value: "> 0"}.Evaluate(out))
+	assert.Error(t, Assertion{Column: "cnt", Value: "> 1"}.Evaluate(out))
+	assert.Error(t, Assertion{Column: "other", Value: "> 0"}.Evaluate(out))
+	out = RunOutput{Rows: pg.NewResult([]string{"cnt"})}
+	assert.Error(t, Assertion{Column: "cnt", Value: "> 0"}.Evaluate(out), "a column without rows should not pass")
+}
+
+func TestAssertion_JSONPath(t *testing.T) {
+	out := RunOutput{StdOut: NewResultFromString("{\"status\": \"ok\",\n \"items\": [{\"size\": 1200, \"my key\": true}]}")}
+	for _, test := range []struct {
+		assertion Assertion
+		passes    bool
+	}{
+		{Assertion{JSONPath: "$.status", Value: "ok"}, true},
+		{Assertion{JSONPath: "$.items[0].size", Value: "> 1000"}, true},
+		{Assertion{JSONPath: `$.items[0]["my key"]`, Value: "true"}, true},
+		{Assertion{JSONPath: "$.items[1]"}, false},
+		{Assertion{JSONPath: "$.missing"}, false},
+	} {
+		err := test.assertion.Evaluate(out)
+		if test.passes {
+			assert.NoError(t, err, "assertion %s should pass", test.assertion.String())
+		} else {
+			assert.Error(t, err, "assertion %s should fail", test.assertion.String())
+		}
+	}
+}
+
+func TestAssertion_Verify(t *testing.T) {
+	assert.Empty(t, Assertion{Rows: ">= 1"}.Verify(true))
+	assert.Len(t, Assertion{Rows: ">= 1"}.Verify(false), 1, "rows assertions require a query check")
+	assert.Len(t, Assertion{RegExp: "a", Line: "b"}.Verify(false), 1, "only one kind of assertion is allowed")
+	assert.Len(t, Assertion{Capture: "took ms", Value: "1"}.Verify(false), 1, "captures require a capture group")
+	assert.Len(t, Assertion{Column: "cnt"}.Verify(true), 1, "column assertions require a value")
+	assert.Len(t, Assertion{Lines: "> x"}.Verify(false), 1, "invalid comparisons should be reported")
+}
+
+func TestAssertions_Evaluate(t *testing.T) {
+	out := RunOutput{StdOut: NewResultFromString("done")}
+	assert.NoError(t, Assertions{{Line: "done"}, {Lines: "1"}}.Evaluate(out))
+	assert.EqualError(t, Assertions{{Line: "done"}, {Name: "nothing", Lines: "0"}, {RegExp: "fail"}}.Evaluate(out),
+		"2 assertion(s) failed: nothing: '1' is not == 0; regexp 'fail' in stdout: no line matches")
+}
@@ -3,193 +3,235 @@ package jobs
 import (
 	"bytes"
 	"fmt"
-	"io"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"sort"
 	"strings"
-	"syscall"
+	"text/tabwriter"
 )
 
-type Checks []*Check
+// CheckResult is the outcome of running one check with one set of (matrix) arguments
+type CheckResult struct {
+	Check    string
+	Instance string
+	Err      error
+}
 
-func (cs *Checks) Run(conns Connections) {
-	for _, check := range *cs {
-		for _, args := range check.Matrix.Instances() {
-			if err := check.Run(conns, args); err != nil {
-				log.Fatalf("Check [%s] failed: %e", check.String(), err)
-			}
+type CheckResults []CheckResult
 
+func (crs CheckResults) Failed() (failed CheckResults) {
+	for _, cr := range crs {
+		if cr.Err != nil {
+			failed = append(failed, cr)
 		}
 	}
+	return failed
 }
 
-func (cs Checks) Clone() (clone Checks) {
-	for _, c := range cs {
-		clone = append(clone, c.Clone())
+// Table returns the results as lines of a table with pass / fail per check and instance
+func (crs CheckResults) Table() []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "CHECK\tINSTANCE\tRESULT\tMESSAGE")
+	for _, cr := range crs {
+		result, message := "pass", ""
+		if cr.Err != nil {
+			result, message = "FAIL", cr.Err.Error()
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", cr.Check, cr.Instance, result, message)
 	}
-	return clone
+	_ = w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
 }
 
-type Check struct {
-	// Home (~) is not resolved
-	File       string     `yaml:"file,omitempty"`
-	Name       string     `yaml:"name"`
-	Role       string     `yaml:"role"`
-	Type       string     `yaml:"type"`
-	Inline     string     `yaml:"inline,omitempty"`
-	BatchMode  bool       `yaml:"batchMode"`
-	Rc         int        `yaml:"rc"`
-	Expected   string     `yaml:"expected,omitempty"`
-	Unexpected string     `yaml:"unexpected,omitempty"`
-	Matrix     MatrixArgs `yaml:"matrix,omitempty"`
-	tmpFile    string
+// CheckWork is one check with one set of (matrix) arguments, to be run by a Runner
+type CheckWork struct {
+	Check  *Check
+	Args   InstanceArguments
+	Result CheckResult
 }
 
-func (c Check) Clone() *Check {
-	return &Check{
-		Name:       c.Name,
-		Role:       c.Role,
-		Type:       c.Type,
-		Inline:     c.Inline,
-		File:       c.File,
-		Matrix:     c.Matrix,
-		BatchMode:  c.BatchMode,
-		Expected:   c.Expected,
-		Unexpected: c.Unexpected,
+// Run runs the check and stores the outcome in Result.
+// A failing check is logged, but does not stop other checks from running.
+func (cw *CheckWork) Run(conns Connections) {
+	if err := cw.Check.Run(conns, cw.Args); err != nil {
+		log.Errorf("Check [%s] failed: %e", cw.Check.String(), err)
+		cw.Result.Err = err
 	}
 }
 
-func (c Check) String() string {
-	var chk string
-	if c.Inline != "" {
-		chk = fmt.Sprintf("inline='%s'", strings.Replace(
-			strings.Replace(c.Inline, "\n", "\\n", -1), "'", "''", -1))
-	} else {
-		chk = fmt.Sprintf("file=%s", c.File)
+type CheckWorkList []*CheckWork
+
+// Results returns the results of all CheckWork in the order of the list
+func (cws CheckWorkList) Results() (results CheckResults) {
+	for _, cw := range cws {
+		results = append(results, cw.Result)
 	}
-	return fmt.Sprintf("name='%s', type=%s, %s", strings.Replace(c.Name, "'", "''", -1), c.Type, chk)
+	return results
 }
 
-func (c Check) VerifyScriptFile() (err error) {
-	if c.Inline != "" {
-		return nil
-	}
-	if c.Type != "shell" {
-		return nil
-	}
-	// Check file exists
-	if info, err := os.Stat(c.File); err != nil {
-		return err
-	} else {
-		// Check file is executable by me
-		// Requires a fix for Windows...
-		mode := info.Mode()
-		stat := info.Sys().(*syscall.Stat_t)
-		if mode&0001 != 0 {
-			return nil
-		} else if mode&0100 != 0 && int(stat.Uid) == os.Getuid() {
-			return nil
-		} else if mode&0010 != 0 && int(stat.Gid) == os.Getgid() {
-			return nil
+type Checks []*Check
+
+// Work returns CheckWork for all checks with all of their (matrix) instances.
+// The order is predictable: checks in order of definition, and instances sorted by their arguments.
+// Every CheckWork has its own clone of the check, so they can safely run in parallel.
+func (cs Checks) Work() (cws CheckWorkList) {
+	for index, check := range cs {
+		name := check.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", index+1)
+		}
+		instances := check.Matrix.Instances()
+		sort.Slice(instances, func(i, j int) bool {
+			return instances[i].String() < instances[j].String()
+		})
+		for _, args := range instances {
+			cws = append(cws, &CheckWork{
+				Check:  check.Clone(),
+				Args:   args,
+				Result: CheckResult{Check: name, Instance: args.String()},
+			})
 		}
-		return fmt.Errorf("script file %s is not executable by me (uid: %d, gid: %d)", c.File, os.Getuid(),
-			os.Getgid())
 	}
+	return cws
 }
 
-func (c Check) Verify(stepName string, conns Connections) (errs []error) {
-	if c.Type == "" {
-		if len(conns) == 1 {
-			// This is fine. When only one, we use that.
-		} else {
-			errs = append(errs, fmt.Errorf(
-				"please reference a specific Type for step check %s.%s, or just define only one Connection",
-				stepName, c.Name))
+func (cs Checks) Verify(conns Connections, strict bool) (errs []error) {
+	for _, check := range cs {
+		for _, err := range check.Script.Verify(conns) {
+			errs = append(errs, fmt.Errorf("check %s: %s", check.Name, err.Error()))
+		}
+		errs = append(errs, check.VerifyArguments(strict)...)
+		errs = append(errs, check.Assertions.Verify(check.IsQuery())...)
+		for _, err := range VerifySqlStates(check.IsQuery(), check.ExpectedSqlState, check.AllowedSqlStates) {
+			errs = append(errs, fmt.Errorf("check %s: %s", check.Name, err.Error()))
 		}
-	} else if c.Type == "shell" {
-		// Special type shell for running shell checks instead of db connection
-	} else if _, exists := conns[c.Type]; !exists {
-		errs = append(errs, fmt.Errorf("step check %s.%s references an unknown Type %s", stepName,
-			c.Type, c.Name))
-	}
-	if err := c.VerifyScriptFile(); err != nil {
-		errs = append(errs, err)
 	}
 	return errs
 }
 
-// ScriptFile returns a path to the script holding the check.
-// This could be the symlink evaluated version of Check.File.
-// Or this could be an executable temporary file with Check.Inline as contents.
-// This is wat is used to run shell checks
-func (c *Check) ScriptFile() (scriptFile string) {
-	var err error
-	var tmpFile *os.File
-	if c.Inline != "" {
-		if tmpFile, err = os.CreateTemp("", "pgQuartsInlineCheck"); err != nil {
-			log.Panicf("error creating tempfile: %e", err)
+// VerifyStepChecks verifies the pre-checks or post-checks of a step.
+// These checks run with the arguments of the step instances, so they are verified against the matrix of the step,
+// and they cannot have a matrix of their own.
+func (cs Checks) VerifyStepChecks(stepName string, conns Connections, matrix MatrixArgs, strict bool) (errs []error) {
+	for _, check := range cs {
+		errs = append(errs, check.Verify(stepName, conns)...)
+		if len(check.Matrix) > 0 {
+			errs = append(errs, fmt.Errorf("step check %s.%s has a matrix, but runs with the arguments of the step",
+				stepName, check.Name))
 		}
-		c.tmpFile = tmpFile.Name()
-		if _, err = tmpFile.WriteString(c.Inline); err != nil {
-			log.Panicf("error writing inline check to tempfile: %e", err)
-		} else if err = tmpFile.Close(); err != nil {
-			log.Panicf("error closing the tmpfile: %e", err)
-			// os.Chmod should also work on Windows
-		} else if err = os.Chmod(tmpFile.Name(), 0600); err != nil {
-			log.Panicf("error making inline tempfile script executable: %e", err)
+		if check.IsQuery() {
+			if body, err := check.ScriptBody(); err != nil {
+				errs = append(errs, err)
+			} else {
+				_, argErrs := matrix.VerifyQuery(body, strict)
+				for _, err = range argErrs {
+					errs = append(errs, fmt.Errorf("step check %s.%s: %s", stepName, check.Name, err.Error()))
+				}
+			}
+		}
+		errs = append(errs, check.Assertions.Verify(check.IsQuery())...)
+		for _, err := range VerifySqlStates(check.IsQuery(), check.ExpectedSqlState, check.AllowedSqlStates) {
+			errs = append(errs, fmt.Errorf("step check %s.%s: %s", stepName, check.Name, err.Error()))
 		}
-		return c.tmpFile
 	}
-	if err = c.VerifyScriptFile(); err != nil {
-		log.Panicf("Cannot run script %s", c.File)
+	return errs
+}
+
+// SetJobContext sets the job context of all checks (with the name of the check)
+func (cs Checks) SetJobContext(jobContext JobContext) {
+	for index, check := range cs {
+		jobContext.Check = check.Name
+		if jobContext.Check == "" {
+			jobContext.Check = fmt.Sprintf("#%d", index+1)
+		}
+		check.jobContext = jobContext
 	}
-	if scriptFile, err = filepath.EvalSymlinks(c.File); err != nil {
-		log.Panicf("error while evaluating SymLinks: %e", err)
+}
+
+func (cs Checks) Clone() (clone Checks) {
+	for _, c := range cs {
+		clone = append(clone, c.Clone())
 	}
-	return scriptFile
+	return clone
 }
 
-// ScriptBody does the exact opposite of ScriptFile.
-// For Check.File it reads the contents.
-// In other situations it just returns Check.Inline.
-// This is wat is used to run checks on database connections.
-func (c Check) ScriptBody() (string, error) {
-	if c.Inline != "" {
-		return c.Inline, nil
+type Check struct {
+	Script           `yaml:",inline"`
+	Rc               int        `yaml:"rc"`
+	Expected         string     `yaml:"expected,omitempty"`
+	Unexpected       string     `yaml:"unexpected,omitempty"`
+	Assertions       Assertions `yaml:"assertions,omitempty"`
+	ExpectedSqlState string     `yaml:"expectedSqlState,omitempty"`
+	AllowedSqlStates []string   `yaml:"allowedSqlStates,omitempty"`
+	Matrix           MatrixArgs `yaml:"matrix,omitempty"`
+}
+
+func (c Check) Clone() *Check {
+	return &Check{
+		Script:           c.Script.Clone(),
+		Matrix:           c.Matrix,
+		Rc:               c.Rc,
+		Expected:         c.Expected,
+		Unexpected:       c.Unexpected,
+		Assertions:       c.Assertions,
+		ExpectedSqlState: c.ExpectedSqlState,
+		AllowedSqlStates: c.AllowedSqlStates,
 	}
-	scriptBodyBytes, err := os.ReadFile(c.File)
-	if err != nil {
-		return "", nil
+}
+
+func (c Check) Verify(stepName string, conns Connections) (errs []error) {
+	for _, err := range c.Script.Verify(conns) {
+		errs = append(errs, fmt.Errorf("step check %s.%s: %s", stepName, c.Name, err.Error()))
 	}
-	return string(scriptBodyBytes), nil
+	return errs
 }
 
-func (c *Check) Run(conns Connections, args InstanceArguments) error {
-	log.Infof("Running check: %s, with arguments %s", c.String(), args.String())
-	if c.Type == "" || c.Type == "shell" {
-		return c.RunOsCheck(args)
-	}
-	if body, err := c.ScriptBody(); err != nil {
-		return err
-	} else if stdOut, err := conns.Execute(c.Type, c.Role, body, c.BatchMode, args); err != nil && c.Rc == 0 {
-		return fmt.Errorf("%s unexpectedly generated an error: %e", c.String(), err)
-	} else if err == nil && c.Rc != 0 {
-		return fmt.Errorf("%s unexpectedly ran without error", c.String())
-	} else if expErr := CheckOutput(stdOut, c.Expected, c.Unexpected); expErr != nil {
-		return fmt.Errorf("%s in stdout", expErr.Error())
+// VerifyArguments checks that all named arguments and templates in a query check are defined in its matrix,
+// and that all arguments in its matrix are used.
+func (c Check) VerifyArguments(strict bool) (errs []error) {
+	if !c.IsQuery() {
+		return nil
 	}
-	return nil
+	body, err := c.ScriptBody()
+	if err != nil {
+		return []error{err}
+	}
+	used, argErrs := c.Matrix.VerifyQuery(body, strict)
+	for _, err = range argErrs {
+		errs = append(errs, fmt.Errorf("check %s: %s", c.Name, err.Error()))
+	}
+	for _, argName := range c.Matrix.Unused(used) {
+		errs = append(errs, fmt.Errorf("check %s has a matrix argument %s which is not used", c.Name, argName))
+	}
+	return errs
 }
 
-func (c *Check) CleanTempFile() {
-	if c.tmpFile != "" {
-		log.Debugf("removing tmp file %s", c.tmpFile)
-		if err := os.Remove(c.tmpFile); err != nil {
-			log.Errorf("error removing file %s: %e", c.tmpFile, err)
+// Run runs the check and returns an error when the output is not as expected.
+// This means an unexpected return code, an unexpected SQLSTATE, (un)expected strings in the output,
+// or one or more failing assertions.
+func (c *Check) Run(conns Connections, args InstanceArguments) (err error) {
+	log.Infof("Running check: %s, with arguments %s", c.String(), args.String())
+	// SQLSTATEs are checked for every statement (see Connections.Execute)
+	c.Script.sqlStates = SqlStates{Expected: c.ExpectedSqlState, Allowed: c.AllowedSqlStates}
+	out, err := c.Script.Run(conns, args)
+	if err != nil && (c.ExpectedSqlState != "" || len(c.AllowedSqlStates) > 0) {
+		return fmt.Errorf("%s: %w", c.String(), err)
+	}
+	if out.Rc != c.Rc {
+		if err != nil {
+			return fmt.Errorf("%s: unexpected returncode (expected=%d, actual = %d): %w", c.String(), c.Rc, out.Rc,
+				err)
 		}
-		c.tmpFile = ""
+		return fmt.Errorf("%s: unexpected returncode (expected=%d, actual = %d)", c.String(), c.Rc, out.Rc)
 	}
+	if expErr := CheckOutput(out.StdOut, c.Expected, c.Unexpected); expErr != nil {
+		return fmt.Errorf("%s in stdout", expErr.Error())
+	} else if c.IsQuery() {
+		// for queries stderr holds notices, which are not checked for (un)expected strings
+	} else if expErr = CheckOutput(out.StdErr, c.Expected, c.Unexpected); expErr != nil {
+		return fmt.Errorf("%s in stderr", expErr.Error())
+	}
+	log.Debugf("check %s successfully executed", c.String())
+	return c.Assertions.Evaluate(out)
 }
 
 func CheckOutput(stdOut Result, expected string, unexpected string) error {
@@ -201,29 +243,3 @@ func CheckOutput(stdOut Result, expected string, unexpected string) error {
 	}
 	return nil
 }
-
-func (c *Check) RunOsCheck(args InstanceArguments) (err error) {
-	exCheck := exec.Command("/bin/bash", c.ScriptFile()) // #nosec
-	exCheck.Env = args.AsEnv()
-	var stdOut, stdErr bytes.Buffer
-	exCheck.Stdout = io.MultiWriter(&stdOut)
-	exCheck.Stderr = io.MultiWriter(&stdErr)
-	defer c.CleanTempFile()
-	if err = exCheck.Run(); err != nil {
-		switch typedErr := err.(type) {
-		case *exec.ExitError:
-			rc := typedErr.ExitCode()
-			if rc != c.Rc {
-				return fmt.Errorf("unexpected returncode (expected=%d, actual = %d)", c.Rc, rc)
-			}
-		default:
-		}
-	}
-	if expErr := CheckOutput(NewResultFromString(stdOut.String()), c.Expected, c.Unexpected); expErr != nil {
-		return fmt.Errorf("%s in stdout", expErr.Error())
-	} else if expErr = CheckOutput(NewResultFromString(stdErr.String()), c.Expected, c.Unexpected); expErr != nil {
-		return fmt.Errorf("%s in stderr", expErr.Error())
-	}
-	log.Debugf("check %s successfully executed", c.String())
-	return nil
-}
@@ -0,0 +1,72 @@
+package jobs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckResults(t *testing.T) {
+	results := CheckResults{
+		{Check: "File exists", Instance: "None"},
+		{Check: "Tables exist", Instance: "{ 'tblname': 't1' }", Err: fmt.Errorf("expected string (t1) not found")},
+	}
+	assert.Len(t, results.Failed(), 1, "only failed results should be returned")
+	assert.Equal(t, []string{
+		"CHECK         INSTANCE             RESULT  MESSAGE",
+		"File exists   None                 pass    ",
+		"Tables exist  { 'tblname': 't1' }  FAIL    expected string (t1) not found",
+	}, results.Table())
+}
+
+func TestChecks_Work(t *testing.T) {
+	checks := Checks{
+		&Check{Script: Script{Name: "second"}, Matrix: MatrixArgs{"a": {"2", "1"}}},
+		&Check{},
+	}
+	var names []string
+	for _, cw := range checks.Work() {
+		names = append(names, cw.Result.Check+" "+cw.Result.Instance)
+		assert.NotSame(t, checks[0], cw.Check, "every CheckWork should have its own clone of the check")
+	}
+	assert.Equal(t, []string{"second " + InstanceArguments{"a": "1"}.String(),
+		"second " + InstanceArguments{"a": "2"}.String(), "#2 " + InstanceArguments{}.String()}, names)
+}
+
+func TestChecks_VerifyStepChecks(t *testing.T) {
+	conns := Connections{"pg": {}}
+	matrix := MatrixArgs{"table": {"t1", "t2"}}
+	checks := Checks{
+		&Check{Script: Script{Name: "empty", Type: "pg", Inline: "select count(*) from ${ident:table}"}},
+		&Check{Script: Script{Name: "shell", Inline: "true"}},
+	}
+	assert.Empty(t, checks.VerifyStepChecks("load", conns, matrix, true))
+	for _, check := range []*Check{
+		{Script: Script{Name: "unknown type", Type: "other", Inline: "select 1"}},
+		{Script: Script{Name: "own matrix", Inline: "true"}, Matrix: MatrixArgs{"a": {"1"}}},
+		{Script: Script{Name: "unknown argument", Type: "pg", Inline: "select :schema"}},
+	} {
+		assert.Len(t, Checks{check}.VerifyStepChecks("load", conns, matrix, true), 1, "check %s should not verify", check.Name)
+	}
+}
+
+func TestInstance_Run(t *testing.T) {
+	failing := Checks{&Check{Script: Script{Name: "failing", Inline: "exit 1"}}}
+	passing := Checks{&Check{Script: Script{Name: "passing", Inline: "exit 0"}}}
+	commands := Commands{&Command{Script: Script{Name: "true", Inline: "true"}}}
+
+	skipped := NewInstance(InstanceArguments{}, commands.Clone(), failing.Clone(), nil)
+	assert.NoError(t, skipped.Run(Connections{}))
+	assert.True(t, skipped.Skipped(), "a failing pre-check should skip the instance")
+	assert.False(t, skipped.Failed())
+
+	failed := NewInstance(InstanceArguments{}, commands.Clone(), passing.Clone(), failing.Clone())
+	assert.Error(t, failed.Run(Connections{}))
+	assert.False(t, failed.Skipped())
+	assert.True(t, failed.Failed(), "a failing post-check should fail the instance")
+
+	ok := NewInstance(InstanceArguments{}, commands.Clone(), passing.Clone(), passing.Clone())
+	assert.NoError(t, ok.Run(Connections{}))
+	assert.False(t, ok.Skipped() || ok.Failed())
+}
@@ -1,21 +1,43 @@
 package jobs
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"syscall"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
+const (
+	commandFormatDefault = ""
+	commandFormatCSV     = "csv"
+	commandFormatJSON    = "json"
 )
 
+var commandFormats = map[string]bool{
+	commandFormatDefault: true,
+	commandFormatCSV:     true,
+	commandFormatJSON:    true,
+}
+
 type Commands []*Command
 
-func (cs Commands) Verify(stepName string, conns Connections) (errs []error) {
+func (cs Commands) Verify(stepName string, conns Connections, matrix MatrixArgs, strict bool) (errs []error) {
+	var used []string
+	allQueries := true
 	for _, command := range cs {
 		errs = append(errs, command.Verify(stepName, conns)...)
+		commandUsed, argErrs := command.VerifyArguments(stepName, matrix, strict)
+		used = append(used, commandUsed...)
+		errs = append(errs, argErrs...)
+		if !command.IsQuery() {
+			// shell commands get all arguments as environment variables, so we cannot detect unused arguments
+			allQueries = false
+		}
+	}
+	if allQueries {
+		for _, argName := range matrix.Unused(used) {
+			errs = append(errs, fmt.Errorf("step %s has a matrix argument %s which is not used by any of its commands",
+				stepName, argName))
+		}
 	}
 	return errs
 }
@@ -29,6 +51,12 @@ func (cs *Commands) Run(conns Connections, args InstanceArguments) (err error) {
 	return nil
 }
 
+func (cs Commands) SetJobContext(jobContext JobContext) {
+	for _, command := range cs {
+		command.jobContext = jobContext
+	}
+}
+
 func (cs Commands) Clone() (clone Commands) {
 	for _, c := range cs {
 		clone = append(clone, c.Clone())
@@ -57,178 +85,108 @@ func (cs Commands) StdErr() (stdErr Result) {
 	return stdErr
 }
 
-type Command struct {
-	// Home (~) is not resolved
-	File      string `yaml:"file,omitempty"`
-	Name      string `yaml:"name"`
-	Role      string `yaml:"role"`
-	Type      string `yaml:"type"`
-	Inline    string `yaml:"inline,omitempty"`
-	BatchMode bool   `yaml:"batchMode"`
-	stdOut    Result `yaml:"-"`
-	stdErr    Result `yaml:"-"`
-	Rc        int    `yaml:"-"`
-	tmpFile   string
-}
-
-func (c Command) Clone() *Command {
-	return &Command{
-		Name:      c.Name,
-		Role:      c.Role,
-		Type:      c.Type,
-		Inline:    c.Inline,
-		File:      c.File,
-		BatchMode: c.BatchMode,
+func (cs Commands) CommandTags() (commandTags Result) {
+	for _, command := range cs {
+		commandTags = append(commandTags, command.commandTags...)
 	}
+	return commandTags
 }
 
-func (c Command) String() string {
-	var cmd string
-	if c.Inline != "" {
-		cmd = fmt.Sprintf("inline='%s'", strings.Replace(
-			strings.Replace(c.Inline, "\n", "\\n", -1), "'", "''", -1))
-	} else {
-		cmd = fmt.Sprintf("file=%s", c.File)
+func (cs Commands) Rows() (rows pg.Result) {
+	for _, command := range cs {
+		rows = rows.Append(command.rows)
 	}
-	return fmt.Sprintf("name='%s', type=%s, %s", strings.Replace(c.Name, "'", "''", -1), c.Type, cmd)
+	return rows
 }
 
-func (c Command) VerifyScriptFile() (err error) {
-	if c.Inline != "" {
-		return nil
-	}
-	if c.Type != "shell" {
-		return nil
-	}
-	// Check file exists
-	if info, err := os.Stat(c.File); err != nil {
-		return err
-	} else {
-		// Check file is executable by me
-		// Requires a fix for Windows...
-		mode := info.Mode()
-		stat := info.Sys().(*syscall.Stat_t)
-		if mode&0001 != 0 {
-			return nil
-		} else if mode&0100 != 0 && int(stat.Uid) == os.Getuid() {
-			return nil
-		} else if mode&0010 != 0 && int(stat.Gid) == os.Getgid() {
-			return nil
+// Outputs returns the named outputs of all commands (when commands return the same name, the last one wins)
+func (cs Commands) Outputs() (outputs map[string]string) {
+	outputs = make(map[string]string)
+	for _, command := range cs {
+		for name, value := range command.outputs {
+			outputs[name] = value
 		}
-		return fmt.Errorf("script file %s is not executable by me (uid: %d, gid: %d)", c.File, os.Getuid(),
-			os.Getgid())
 	}
+	return outputs
 }
 
-func (c Command) Verify(stepName string, conns Connections) (errs []error) {
-	if c.Type == "" {
-		if len(conns) == 1 {
-			// This is fine. When only one, we use that.
-		} else {
-			errs = append(errs, fmt.Errorf(
-				"please reference a specific Type for step command %s.%s, or just define only one Connection",
-				stepName, c.Name))
-		}
-	} else if c.Type == "shell" {
-		// Special type shell for running shell commands instead of db connection
-	} else if _, exists := conns[c.Type]; !exists {
-		errs = append(errs, fmt.Errorf("step command %s.%s references an unknown Type %s", stepName,
-			c.Type, c.Name))
+func (cs Commands) RowsAffected() (rowsAffected int64) {
+	for _, command := range cs {
+		rowsAffected += command.RowsAffected
 	}
-	if err := c.VerifyScriptFile(); err != nil {
-		errs = append(errs, err)
+	return rowsAffected
+}
+
+type Command struct {
+	Script           `yaml:",inline"`
+	Format           string   `yaml:"format,omitempty"`
+	ExpectedSqlState string   `yaml:"expectedSqlState,omitempty"`
+	AllowedSqlStates []string `yaml:"allowedSqlStates,omitempty"`
+	stdOut           Result   `yaml:"-"`
+	stdErr           Result   `yaml:"-"`
+	commandTags      Result   `yaml:"-"`
+	rows             pg.Result
+	outputs          map[string]string
+	Rc               int   `yaml:"-"`
+	RowsAffected     int64 `yaml:"-"`
+}
+
+func (c Command) Clone() *Command {
+	return &Command{
+		Script:           c.Script.Clone(),
+		Format:           c.Format,
+		ExpectedSqlState: c.ExpectedSqlState,
+		AllowedSqlStates: c.AllowedSqlStates,
 	}
-	return errs
 }
 
-// ScriptFile returns a path to the script holding the command.
-// This could be the symlink evaluated version of Command.File.
-// Or this could be an executable temporary file with Command.Inline as contents.
-// This is wat is used to run shell commands
-func (c *Command) ScriptFile() (scriptFile string) {
-	var err error
-	var tmpFile *os.File
-	if c.Inline != "" {
-		if tmpFile, err = os.CreateTemp("", "pgQuartsInlineCommand"); err != nil {
-			log.Panicf("error creating tempfile: %e", err)
-		}
-		c.tmpFile = tmpFile.Name()
-		if _, err = tmpFile.WriteString(c.Inline); err != nil {
-			log.Panicf("error writing inline command to tempfile: %e", err)
-		} else if err = tmpFile.Close(); err != nil {
-			log.Panicf("error closing the tmpfile: %e", err)
-			// os.Chmod should also work on Windows
-		} else if err = os.Chmod(tmpFile.Name(), 0600); err != nil {
-			log.Panicf("error making inline tempfile script executable: %e", err)
-		}
-		return c.tmpFile
+func (c Command) Verify(stepName string, conns Connections) (errs []error) {
+	for _, err := range c.Script.Verify(conns) {
+		errs = append(errs, fmt.Errorf("step command %s.%s: %s", stepName, c.Name, err.Error()))
 	}
-	if err = c.VerifyScriptFile(); err != nil {
-		log.Panicf("Cannot run script %s", c.File)
+	for _, err := range VerifySqlStates(c.IsQuery(), c.ExpectedSqlState, c.AllowedSqlStates) {
+		errs = append(errs, fmt.Errorf("step command %s.%s: %s", stepName, c.Name, err.Error()))
 	}
-	if scriptFile, err = filepath.EvalSymlinks(c.File); err != nil {
-		log.Panicf("error while evaluating SymLinks: %e", err)
+	if _, exists := commandFormats[c.Format]; !exists {
+		errs = append(errs, fmt.Errorf("step command %s.%s has an invalid format %s", stepName, c.Name, c.Format))
 	}
-	return scriptFile
+	return errs
 }
 
-// ScriptBody does the exact opposite of ScriptFile.
-// For Command.File it reads the contents.
-// In other situations it just returns Command.Inline.
-// This is wat is used to run commands on database connections.
-func (c Command) ScriptBody() (string, error) {
-	if c.Inline != "" {
-		return c.Inline, nil
+// VerifyArguments checks that all named arguments and templates in a query command are defined in the matrix.
+// It returns the matrix arguments that are used by the query.
+func (c Command) VerifyArguments(stepName string, matrix MatrixArgs, strict bool) (used []string, errs []error) {
+	if !c.IsQuery() {
+		return nil, nil
 	}
-	scriptBodyBytes, err := os.ReadFile(c.File)
+	body, err := c.ScriptBody()
 	if err != nil {
-		return "", nil
+		return nil, []error{err}
+	}
+	used, argErrs := matrix.VerifyQuery(body, strict)
+	for _, err = range argErrs {
+		errs = append(errs, fmt.Errorf("step command %s.%s: %s", stepName, c.Name, err.Error()))
 	}
-	return string(scriptBodyBytes), nil
+	return used, errs
 }
 
 func (c *Command) Run(conns Connections, args InstanceArguments) (err error) {
 	log.Infof("Running command: %s, args: %s", c.String(), args.String())
-	if c.Type == "" || c.Type == "shell" {
-		return c.RunOsCommand(args)
-	}
-	if body, err := c.ScriptBody(); err != nil {
-		return err
-	} else if c.stdOut, err = conns.Execute(c.Type, c.Role, body, c.BatchMode, args); err != nil {
-		c.Rc = 1
-		return err
+	// SQLSTATEs are checked for every statement (see Connections.Execute)
+	c.Script.sqlStates = SqlStates{Expected: c.ExpectedSqlState, Allowed: c.AllowedSqlStates}
+	out, err := c.Script.Run(conns, args)
+	c.stdOut, c.stdErr, c.commandTags, c.RowsAffected = out.StdOut, out.StdErr, out.CommandTags, out.RowsAffected
+	c.rows, c.outputs = out.Rows, out.Outputs
+	switch c.Format {
+	case commandFormatCSV:
+		c.stdOut = NewResultFromString(c.rows.AsCSV())
+	case commandFormatJSON:
+		c.stdOut = NewResultFromString(c.rows.AsJSON())
 	}
-	return nil
-}
-
-func (c *Command) CleanTempFile() {
-	if c.tmpFile != "" {
-		log.Debugf("removing tmp file %s", c.tmpFile)
-		if err := os.Remove(c.tmpFile); err != nil {
-			log.Errorf("error removing file %s: %e", c.tmpFile, err)
-		}
-		c.tmpFile = ""
-	}
-}
-
-func (c *Command) RunOsCommand(args InstanceArguments) (err error) {
-	exCommand := exec.Command("/bin/bash", c.ScriptFile()) // #nosec
-	exCommand.Env = args.AsEnv()
-	var stdOut, stdErr bytes.Buffer
-	exCommand.Stdout = io.MultiWriter(&stdOut)
-	exCommand.Stderr = io.MultiWriter(&stdErr)
-	defer c.CleanTempFile()
-	if err = exCommand.Run(); err != nil {
-		switch typedErr := err.(type) {
-		case *exec.ExitError:
-			c.Rc = typedErr.ExitCode()
-		default:
-			c.Rc = 1
-		}
+	if err != nil {
+		c.Rc = out.Rc
 		return err
 	}
-	c.stdOut = NewResultFromString(stdOut.String())
-	c.stdErr = NewResultFromString(stdErr.String())
 	log.Debugf("command %s successfully executed", c.String())
 	return nil
 }
@@ -7,34 +7,70 @@ import (
 
 	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
 	"github.com/mannemsolutions/PgQuartz/pkg/git"
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
+	"github.com/mannemsolutions/PgQuartz/pkg/secrets"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Git            git.Config  `yaml:"git"`
-	Steps          Steps       `yaml:"steps"`
-	Checks         Checks      `yaml:"checks"`
-	Target         Target      `yaml:"target"`
-	Conns          Connections `yaml:"connections"`
-	Alert          []Alert     `yaml:"alerts"`
-	Log            []Log       `yaml:"log"`
-	Debug          bool        `yaml:"debug"`
-	RunOnRoleError bool        `yaml:"runOnRoleError"`
-	LogFile        string      `yaml:"logFile"`
-	Parallel       int         `yaml:"parallel"`
-	Workdir        string      `yaml:"workdir"`
-	EtcdConfig     etcd.Config `yaml:"etcdConfig"`
-	Timeout        string      `yaml:"timeout"`
+	Name            string      `yaml:"name,omitempty"`
+	Git             git.Config  `yaml:"git"`
+	Steps           Steps       `yaml:"steps"`
+	Checks          Checks      `yaml:"checks"`
+	Target          Target      `yaml:"target"`
+	Conns           Connections `yaml:"connections"`
+	Alert           Alerts      `yaml:"alerts"`
+	Log             []Log       `yaml:"log"`
+	Debug           bool        `yaml:"debug"`
+	RunOnRoleError  bool        `yaml:"runOnRoleError"`
+	LogFile         string      `yaml:"logFile"`
+	Parallel        int         `yaml:"parallel"`
+	Workdir         string      `yaml:"workdir"`
+	EtcdConfig      etcd.Config `yaml:"etcdConfig"`
+	Lock            lock.Config `yaml:"lock"`
+	Timeout         string      `yaml:"timeout"`
+	StrictTemplates bool        `yaml:"strictTemplates"`
+	ChecksParallel  int         `yaml:"checksParallel"`
 }
 
+// String returns the config as yaml, with all secrets masked
 func (c Config) String() string {
 	if yamlConfig, err := yaml.Marshal(&c); err != nil {
 		return ""
 	} else {
-		return string(yamlConfig)
+		return secrets.Mask(string(yamlConfig), c.passwords()...)
 	}
 }
 
+// passwords returns all passwords and tokens in the config, so that they can be masked (also when they are not
+// references to secrets)
+func (c Config) passwords() (passwords []string) {
+	passwords = append(passwords, c.Git.HttpPassword, c.EtcdConfig.Password)
+	for _, conn := range c.Conns {
+		passwords = append(passwords, conn.ConnParams["password"])
+	}
+	var scripts []Script
+	checks := c.Checks
+	for _, step := range c.Steps {
+		for _, command := range step.Commands {
+			scripts = append(scripts, command.Script)
+		}
+		checks = append(append(checks, step.PreChecks...), step.PostChecks...)
+	}
+	for _, check := range checks {
+		scripts = append(scripts, check.Script)
+	}
+	for _, script := range scripts {
+		if script.HTTP == nil {
+			continue
+		} else if script.HTTP.BasicAuth != nil {
+			passwords = append(passwords, script.HTTP.BasicAuth.Password)
+		}
+		passwords = append(passwords, script.HTTP.BearerToken)
+	}
+	return passwords
+}
+
 func (c Config) Verify() {
 	var errs []error
 	if c.Parallel < 0 {
@@ -43,10 +79,19 @@ func (c Config) Verify() {
 		// More would be static, less than 0 is invalid.
 		// Not using uint, because we only loop through this and don;t want to convert to int in the loop...
 		errs = append(errs, fmt.Errorf("invalid value for Parallel %d", c.Parallel))
+	} else if c.ChecksParallel < 0 {
+		errs = append(errs, fmt.Errorf("invalid value for ChecksParallel %d", c.ChecksParallel))
 	} else if len(c.Steps) < 1 {
 		errs = append(errs, fmt.Errorf("please define at least one step"))
 	} else {
-		errs = append(errs, c.Steps.Verify(c.Conns)...)
+		errs = append(errs, c.Conns.VerifyExecutorTypes()...)
+		errs = append(errs, c.Conns.Verify()...)
+		errs = append(errs, c.Lock.Verify(c.Conns)...)
+		errs = append(errs, c.Steps.VerifyLocks(c.Lock, c.Conns)...)
+		errs = append(errs, c.EtcdConfig.Verify()...)
+		errs = append(errs, c.verifyEtcdLockKeys()...)
+		errs = append(errs, c.Steps.Verify(c.Conns, c.StrictTemplates)...)
+		errs = append(errs, c.Checks.Verify(c.Conns, c.StrictTemplates)...)
 	}
 	for _, err := range errs {
 		log.Error(err)
@@ -56,11 +101,41 @@ func (c Config) Verify() {
 	}
 }
 
+// verifyEtcdLockKeys returns all etcd locks (of the job and its steps) that conflict with the status keys in etcd
+func (c Config) verifyEtcdLockKeys() (errs []error) {
+	locks := []lock.Config{c.Lock}
+	for _, step := range c.Steps {
+		if step.Lock != nil {
+			locks = append(locks, *step.Lock)
+		}
+	}
+	for _, l := range locks {
+		if l.Backend != lock.BackendEtcd {
+			continue
+		} else if err := c.EtcdConfig.VerifyLockKey(l.Key, c.Name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
 func (c *Config) Initialize() {
 	c.Git.Initialize(git.Folder(c.Workdir))
+	c.Steps.SetJobContext(c.Name)
+	c.Checks.SetJobContext(JobContext{Job: c.Name})
 	c.Steps.Initialize()
 }
 
+// GetChecksParallel returns the number of runners for checks, which defaults to Parallel
+func (c Config) GetChecksParallel() int {
+	if c.ChecksParallel > 0 {
+		return c.ChecksParallel
+	} else if c.Parallel > 0 {
+		return c.Parallel
+	}
+	return 1
+}
+
 func (c Config) GetTimeoutContext(parentContext context.Context) (context.Context, context.CancelFunc) {
 	if c.Timeout == "" {
 		return parentContext, nil
@@ -0,0 +1,45 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
+	"github.com/mannemsolutions/PgQuartz/pkg/git"
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_String(t *testing.T) {
+	config := Config{
+		Git:        git.Config{HttpPassword: "gitPassword"},
+		EtcdConfig: etcd.Config{Username: "pgquartz", Password: "etcdPassword"},
+		Conns:      Connections{"pg": pg.NewConn(pg.Dsn{"password": "pgPassword"})},
+		Steps: Steps{"step": &Step{
+			Commands: Commands{{Script: Script{HTTP: &HTTPRequest{BearerToken: "bearerToken"}}}},
+			PostChecks: Checks{{Script: Script{HTTP: &HTTPRequest{
+				BasicAuth: &HTTPBasicAuth{User: "me", Password: "httpPassword"}}}}},
+		}},
+	}
+	dump := config.String()
+	for _, password := range []string{"gitPassword", "etcdPassword", "pgPassword", "bearerToken", "httpPassword"} {
+		assert.NotContains(t, dump, password)
+	}
+	assert.Contains(t, dump, "user: me")
+}
+
+func TestConfig_VerifyEtcdLockKeys(t *testing.T) {
+	config := Config{
+		Name:  "job1",
+		Lock:  lock.Config{Backend: lock.BackendEtcd, Key: "job1"},
+		Steps: Steps{"step1": &Step{Lock: &lock.Config{Backend: lock.BackendEtcd, Key: "status"}}},
+	}
+	assert.Len(t, config.verifyEtcdLockKeys(), 1, "step locks should not conflict with the status keys")
+	config.Steps["step1"].Lock.Backend = lock.BackendFlock
+	assert.Empty(t, config.verifyEtcdLockKeys(), "only etcd locks can conflict with the status keys")
+
+	config.EtcdConfig.StatusKeyTemplate = "${prefix}/${job}/status/${runId}"
+	assert.Len(t, config.verifyEtcdLockKeys(), 1, "the lock of the job should not contain its status keys")
+	config.Lock.Key = "shared"
+	assert.Empty(t, config.verifyEtcdLockKeys())
+}
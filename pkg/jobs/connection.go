@@ -2,42 +2,154 @@ package jobs
 
 import (
 	"fmt"
-	"strings"
+	"regexp"
 
 	"github.com/mannemsolutions/PgQuartz/pkg/pg"
 )
 
-type Connections map[string]pg.Conn
+var sqlStateRegExp = regexp.MustCompile(`^[0-9A-Z]{5}$`)
 
-func (cs Connections) Execute(connName string, role string, query string, batchMode bool, args InstanceArguments) (result Result, err error) {
+// SqlStates are the SQLSTATEs a query is expected to fail with (Expected) or allowed to fail with (Allowed), see
+// CheckSqlState. In batchMode, they apply to every statement of the batch.
+type SqlStates struct {
+	Expected string
+	Allowed  []string
+}
+
+// VerifySqlStates checks the format of expected and allowed SQLSTATE codes, which can only be used on queries.
+func VerifySqlStates(isQuery bool, expected string, allowed []string) (errs []error) {
+	if !isQuery && (expected != "" || len(allowed) > 0) {
+		return []error{fmt.Errorf("expectedSqlState and allowedSqlStates can only be used on queries")}
+	}
+	for _, state := range append([]string{expected}, allowed...) {
+		if state != "" && !sqlStateRegExp.MatchString(state) {
+			errs = append(errs, fmt.Errorf("invalid SQLSTATE %s (should be 5 digits / uppercase letters)", state))
+		}
+	}
+	return errs
+}
+
+// CheckSqlState decides if the result of a query (err) is acceptable:
+// - when expected is set, the query should have failed with that exact SQLSTATE
+// - when the query failed with one of the allowed SQLSTATEs, this is treated as success
+// It returns nil when the result is acceptable, and an error otherwise.
+func CheckSqlState(err error, expected string, allowed []string) error {
+	state := pg.SqlState(err)
+	if expected != "" {
+		if err == nil {
+			return fmt.Errorf("expected SQLSTATE %s, but the query ran without error", expected)
+		} else if state != expected {
+			return fmt.Errorf("expected SQLSTATE %s, but the query failed with: %s", expected, err.Error())
+		}
+		log.Infof("query failed with SQLSTATE %s as expected", state)
+		return nil
+	}
+	if state == "" {
+		return err
+	}
+	for _, allowedState := range allowed {
+		if state == allowedState {
+			log.Infof("query failed with allowed SQLSTATE %s: %s", state, err.Error())
+			return nil
+		}
+	}
+	return err
+}
+
+type Connections map[string]*pg.Conn
+
+// Close closes all connections (or releases all sessions for pinned connections, see Pin)
+func (cs Connections) Close() {
+	for _, c := range cs {
+		c.Close()
+	}
+}
+
+// Pin returns Connections where every connection runs all of its queries in one session.
+// Connections are pinned lazily, so a session is only taken from the pool when a query is run on it.
+// All sessions should be released with Close.
+func (cs Connections) Pin() Connections {
+	pinned := make(Connections)
+	for name, c := range cs {
+		pinned[name] = c.Pin()
+	}
+	return pinned
+}
+
+// QueryResult holds the combined output of all queries run by Connections.Execute
+// - StdOut holds the rows (formatted as {name}={value})
+// - StdErr holds the notices and warnings raised by the server (and the error if a query failed)
+// - CommandTags holds the command tags (e.a. `DELETE 3`)
+// - RowsAffected holds the sum of rows affected (or returned) by all queries
+// - Rows holds all rows (with the header) as returned by all queries
+type QueryResult struct {
+	StdOut       Result
+	StdErr       Result
+	CommandTags  Result
+	RowsAffected int64
+	Rows         pg.Result
+}
+
+func (qr *QueryResult) add(response pg.Result) {
+	qr.StdOut = qr.StdOut.Append(NewResult(response.AsStringArray()))
+	qr.StdErr = qr.StdErr.Append(NewResult(response.Notices()))
+	if tag := response.CommandTag(); tag != "" {
+		qr.CommandTags = append(qr.CommandTags, ResultLine(tag))
+	}
+	qr.RowsAffected += response.RowsAffected()
+	qr.Rows = qr.Rows.Append(response)
+}
+
+// Verify returns all issues with the (role) config of the connections
+func (cs Connections) Verify() (errs []error) {
+	for connName, conn := range cs {
+		for _, err := range conn.Verify() {
+			errs = append(errs, fmt.Errorf("connection %s: %w", connName, err))
+		}
+	}
+	return errs
+}
+
+// Execute runs a query (or every statement of a query in batchMode) on a connection, where a failing statement with
+// an allowed (or the expected) SQLSTATE is treated as success (see CheckSqlState), and the batch continues.
+func (cs Connections) Execute(connName string, role string, query string, batchMode bool, opts pg.QueryOptions,
+	states SqlStates, args InstanceArguments) (result QueryResult, err error) {
 	var response pg.Result
-	var c pg.Conn
+	var c *pg.Conn
 	var exists bool
 	if c, exists = cs[connName]; !exists {
-		return nil, fmt.Errorf("connection %s does not exist", connName)
-	} else if err = c.VerifyRole(role); err != nil {
+		return result, fmt.Errorf("connection %s does not exist", connName)
+	} else if c.MultiHost() {
+		// Instead of skipping, the query runs on a host that has the role
+		opts.Role = role
+	} else if err = c.VerifyRole(role, opts.RoleOptions); err != nil {
 		log.Infof("skipping command %s (%s): %s", query, args.String(), err.Error())
 		return result, err
 	}
 
+	queries := []string{query}
 	if batchMode {
-		for _, qry := range strings.Split(query, ";") {
-			numberedArgsQuery, numberedArgs := args.ParseQuery(qry)
-			if response, err = c.GetAll(numberedArgsQuery, numberedArgs...); err != nil {
-				log.Debugf("error occurred on query %s (%s): %s", qry, args.String(), err.Error())
-				return nil, err
-			} else {
-				result = result.Append(NewResult(response.AsStringArray()))
-			}
-		}
-		return result, nil
-	} else {
-		numberedArgsQuery, numberedArgs := args.ParseQuery(query)
-		if response, err = c.GetAll(numberedArgsQuery, numberedArgs...); err != nil {
-			log.Debugf("error occurred on query %s (%s): %s", query, args.String(), err.Error())
-			return nil, err
-		} else {
-			return NewResult(response.AsStringArray()), nil
+		queries = SplitStatements(query)
+		if !c.Pinned() {
+			// All statements of a batch run in one session (unless the session is already shared, see pinSession)
+			c = c.Pin()
+			defer c.Close()
+		}
+	}
+	for _, qry := range queries {
+		numberedArgsQuery, numberedArgs, err := args.ParseQuery(qry)
+		if err != nil {
+			return result, err
+		}
+		response, err = c.GetAll(opts, numberedArgsQuery, numberedArgs...)
+		result.add(response)
+		if err != nil {
+			log.Debugf("error occurred on query %s (%s): %s", qry, args.String(), err.Error())
+			result.StdErr = append(result.StdErr, ResultLine(err.Error()))
+		}
+		if err = CheckSqlState(err, states.Expected, states.Allowed); err != nil {
+			return result, err
 		}
 	}
+	return result, nil
 }
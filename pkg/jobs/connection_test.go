@@ -0,0 +1,29 @@
+package jobs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSqlState(t *testing.T) {
+	uniqueViolation := fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "23505", Message: "duplicate key"})
+	otherErr := fmt.Errorf("connection refused")
+
+	assert.NoError(t, CheckSqlState(nil, "", nil))
+	assert.Equal(t, otherErr, CheckSqlState(otherErr, "", []string{"23505"}))
+	assert.NoError(t, CheckSqlState(uniqueViolation, "", []string{"42P07", "23505"}))
+	assert.Error(t, CheckSqlState(uniqueViolation, "", []string{"42P07"}))
+	assert.NoError(t, CheckSqlState(uniqueViolation, "23505", nil))
+	assert.Error(t, CheckSqlState(uniqueViolation, "42501", nil))
+	assert.Error(t, CheckSqlState(nil, "23505", nil), "expecting a SQLSTATE means the query should fail")
+}
+
+func TestVerifySqlStates(t *testing.T) {
+	assert.Empty(t, VerifySqlStates(true, "23505", []string{"42P07"}))
+	assert.Len(t, VerifySqlStates(true, "2350", []string{"42p07"}), 2)
+	assert.Len(t, VerifySqlStates(false, "23505", nil), 1, "SQLSTATEs can only be used on queries")
+	assert.Empty(t, VerifySqlStates(true, "", nil))
+}
@@ -0,0 +1,350 @@
+package jobs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
+const (
+	executorTypeDefault = ""
+	executorTypeShell   = "shell"
+	executorTypePlugin  = "exec-plugin"
+)
+
+// Executor runs scripts of a specific type.
+// Executors are registered by type name (see RegisterExecutor) and are shared by commands and checks.
+// Scripts with a type that has no registered Executor are run as queries on the Connection with that name.
+type Executor interface {
+	// Verify is called while verifying the job config, and returns all issues that would prevent the script from running
+	Verify(script Script, conns Connections) []error
+	// Execute runs the script with the arguments and returns everything the script returned.
+	// When the script fails, an error is returned and out.Rc should be set to a non-zero value.
+	Execute(script *Script, conns Connections, args InstanceArguments) (out RunOutput, err error)
+}
+
+var executors = map[string]Executor{
+	executorTypeDefault: shellExecutor{},
+	executorTypeShell:   shellExecutor{},
+	executorTypePlugin:  pluginExecutor{},
+	executorTypeHTTP:    httpExecutor{},
+}
+
+// RegisterExecutor registers an Executor for a type name, so that commands and checks can use it with `type: <name>`.
+// This can be used to add types from a small wrapper main, before the job is loaded.
+// Registering an Executor for a type name that is already registered replaces the existing Executor.
+func RegisterExecutor(typeName string, executor Executor) {
+	if typeName == executorTypeDefault {
+		panic("cannot register an executor for the default type")
+	}
+	executors[typeName] = executor
+}
+
+// ExecutorTypes returns the names of all registered Executor types (sorted)
+func ExecutorTypes() (typeNames []string) {
+	for typeName := range executors {
+		if typeName != executorTypeDefault {
+			typeNames = append(typeNames, typeName)
+		}
+	}
+	sort.Strings(typeNames)
+	return typeNames
+}
+
+// GetExecutor returns the Executor registered for the type name, and the query Executor for all other type names
+func GetExecutor(typeName string) Executor {
+	if executor, exists := executors[typeName]; exists {
+		return executor
+	}
+	return queryExecutor{}
+}
+
+// VerifyExecutorTypes returns an error for every connection that has the name of a registered Executor type
+func (conns Connections) VerifyExecutorTypes() (errs []error) {
+	for connName := range conns {
+		if _, exists := executors[connName]; exists {
+			errs = append(errs, fmt.Errorf("connection %s has the same name as an executor type", connName))
+		}
+	}
+	return errs
+}
+
+// RunOutput holds everything a script returned, so that commands can store it and assertions can be evaluated against it
+type RunOutput struct {
+	Rc           int
+	StdOut       Result
+	StdErr       Result
+	CommandTags  Result
+	RowsAffected int64
+	Rows         pg.Result
+	Outputs      map[string]string
+	Duration     time.Duration
+}
+
+// JobContext describes where a script is run
+type JobContext struct {
+	Job   string `json:"job"`
+	Step  string `json:"step,omitempty"`
+	Check string `json:"check,omitempty"`
+}
+
+// ApplicationName returns the default application_name for sessions that run queries in this context
+func (jc JobContext) ApplicationName() string {
+	parts := []string{"pgquartz", jc.Job}
+	if jc.Step != "" {
+		parts = append(parts, jc.Step)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Script holds everything commands and checks have in common: what to run, and how to run it.
+// MaxLag, SyncStandbys and Session override the role options and session settings of the connection for queries.
+type Script struct {
+	// Home (~) is not resolved
+	File         string             `yaml:"file,omitempty"`
+	Name         string             `yaml:"name"`
+	Role         string             `yaml:"role"`
+	MaxLag       string             `yaml:"maxLag,omitempty"`
+	SyncStandbys int                `yaml:"syncStandbys,omitempty"`
+	Type         string             `yaml:"type"`
+	Inline       string             `yaml:"inline,omitempty"`
+	BatchMode    bool               `yaml:"batchMode"`
+	NullString   string             `yaml:"nullString,omitempty"`
+	Plugin       string             `yaml:"plugin,omitempty"`
+	HTTP         *HTTPRequest       `yaml:"http,omitempty"`
+	Session      pg.SessionSettings `yaml:"session,omitempty"`
+	sqlStates    SqlStates
+	jobContext   JobContext
+	tmpFile      string
+}
+
+func (s Script) Clone() Script {
+	return Script{
+		File:         s.File,
+		Name:         s.Name,
+		Role:         s.Role,
+		MaxLag:       s.MaxLag,
+		SyncStandbys: s.SyncStandbys,
+		Type:         s.Type,
+		Inline:       s.Inline,
+		BatchMode:    s.BatchMode,
+		NullString:   s.NullString,
+		Plugin:       s.Plugin,
+		HTTP:         s.HTTP,
+		Session:      s.Session,
+		sqlStates:    s.sqlStates,
+		jobContext:   s.jobContext,
+	}
+}
+
+func (s Script) String() string {
+	var body string
+	if s.Inline != "" {
+		body = fmt.Sprintf("inline='%s'", strings.Replace(
+			strings.Replace(s.Inline, "\n", "\\n", -1), "'", "''", -1))
+	} else {
+		body = fmt.Sprintf("file=%s", s.File)
+	}
+	return fmt.Sprintf("name='%s', type=%s, %s", strings.Replace(s.Name, "'", "''", -1), s.Type, body)
+}
+
+// JobContext returns where the script is run (job, and step or check)
+func (s Script) JobContext() JobContext {
+	return s.jobContext
+}
+
+// Executor returns the Executor that runs this script
+func (s Script) Executor() Executor {
+	return GetExecutor(s.Type)
+}
+
+// IsQuery returns true when the script is run as a query on a database connection
+func (s Script) IsQuery() bool {
+	_, isQuery := s.Executor().(queryExecutor)
+	return isQuery
+}
+
+// RoleOptions returns the role options of the script (options that are not set default to those of the connection)
+func (s Script) RoleOptions() (opts pg.RoleOptions, err error) {
+	if s.MaxLag != "" {
+		if opts.MaxLag, err = time.ParseDuration(s.MaxLag); err != nil {
+			return opts, fmt.Errorf("%s has an invalid maxLag: %s", s.String(), err.Error())
+		}
+	}
+	if s.SyncStandbys < 0 {
+		return opts, fmt.Errorf("%s has an invalid syncStandbys %d", s.String(), s.SyncStandbys)
+	}
+	opts.SyncStandbys = s.SyncStandbys
+	return opts, nil
+}
+
+// Verify returns all issues that would prevent the script from being run by its Executor
+func (s Script) Verify(conns Connections) []error {
+	return s.Executor().Verify(s, conns)
+}
+
+// Run runs the script with its Executor and returns the output, including how long it took
+func (s *Script) Run(conns Connections, args InstanceArguments) (out RunOutput, err error) {
+	start := time.Now()
+	out, err = s.Executor().Execute(s, conns, args)
+	out.Duration = time.Since(start)
+	if err != nil && out.Rc == 0 {
+		out.Rc = 1
+	}
+	log.Debugf("script %s ran in %s (rc=%d)", s.String(), out.Duration.String(), out.Rc)
+	return out, err
+}
+
+func (s Script) VerifyScriptFile() (err error) {
+	if s.Inline != "" {
+		return nil
+	}
+	// Check file exists
+	if info, err := os.Stat(s.File); err != nil {
+		return err
+	} else {
+		// Check file is executable by me
+		// Requires a fix for Windows...
+		mode := info.Mode()
+		stat := info.Sys().(*syscall.Stat_t)
+		if mode&0001 != 0 {
+			return nil
+		} else if mode&0100 != 0 && int(stat.Uid) == os.Getuid() {
+			return nil
+		} else if mode&0010 != 0 && int(stat.Gid) == os.Getgid() {
+			return nil
+		}
+		return fmt.Errorf("script file %s is not executable by me (uid: %d, gid: %d)", s.File, os.Getuid(),
+			os.Getgid())
+	}
+}
+
+// ScriptFile returns a path to the script.
+// This could be the symlink evaluated version of Script.File.
+// Or this could be an executable temporary file with Script.Inline as contents (see CleanTempFile).
+// This is wat is used to run shell scripts
+func (s *Script) ScriptFile() (scriptFile string) {
+	var err error
+	var tmpFile *os.File
+	if s.Inline != "" {
+		if tmpFile, err = os.CreateTemp("", "pgQuartsInlineScript"); err != nil {
+			log.Panicf("error creating tempfile: %e", err)
+		}
+		s.tmpFile = tmpFile.Name()
+		if _, err = tmpFile.WriteString(s.Inline); err != nil {
+			log.Panicf("error writing inline script to tempfile: %e", err)
+		} else if err = tmpFile.Close(); err != nil {
+			log.Panicf("error closing the tmpfile: %e", err)
+			// os.Chmod should also work on Windows
+		} else if err = os.Chmod(tmpFile.Name(), 0600); err != nil {
+			log.Panicf("error making inline tempfile script executable: %e", err)
+		}
+		return s.tmpFile
+	}
+	if err = s.VerifyScriptFile(); err != nil {
+		log.Panicf("Cannot run script %s", s.File)
+	}
+	if scriptFile, err = filepath.EvalSymlinks(s.File); err != nil {
+		log.Panicf("error while evaluating SymLinks: %e", err)
+	}
+	return scriptFile
+}
+
+// ScriptBody does the exact opposite of ScriptFile.
+// For Script.File it reads the contents.
+// In other situations it just returns Script.Inline.
+// This is wat is used to run queries on database connections.
+func (s Script) ScriptBody() (string, error) {
+	if s.Inline != "" {
+		return s.Inline, nil
+	}
+	scriptBodyBytes, err := os.ReadFile(s.File)
+	if err != nil {
+		return "", err
+	}
+	return string(scriptBodyBytes), nil
+}
+
+func (s *Script) CleanTempFile() {
+	if s.tmpFile != "" {
+		log.Debugf("removing tmp file %s", s.tmpFile)
+		if err := os.Remove(s.tmpFile); err != nil {
+			log.Errorf("error removing file %s: %e", s.tmpFile, err)
+		}
+		s.tmpFile = ""
+	}
+}
+
+// shellExecutor runs scripts in bash, with the arguments set as environment variables
+type shellExecutor struct{}
+
+func (se shellExecutor) Verify(script Script, _ Connections) (errs []error) {
+	if err := script.VerifyScriptFile(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (se shellExecutor) Execute(script *Script, _ Connections, args InstanceArguments) (out RunOutput, err error) {
+	exScript := exec.CommandContext(ctx, "/bin/bash", script.ScriptFile()) // #nosec
+	defer script.CleanTempFile()
+	exScript.Env = args.AsEnv()
+	var stdOut, stdErr bytes.Buffer
+	exScript.Stdout = &stdOut
+	exScript.Stderr = &stdErr
+	err = exScript.Run()
+	out.StdOut = NewResultFromString(stdOut.String())
+	out.StdErr = NewResultFromString(stdErr.String())
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		out.Rc = exitErr.ExitCode()
+	}
+	return out, err
+}
+
+// queryExecutor runs scripts as queries on the Connection that has the type of the script as name
+type queryExecutor struct{}
+
+func (qe queryExecutor) Verify(script Script, conns Connections) (errs []error) {
+	if _, exists := conns[script.Type]; !exists {
+		errs = append(errs, fmt.Errorf("%s references an unknown Type %s", script.String(), script.Type))
+	}
+	if _, err := script.ScriptBody(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := script.RoleOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (qe queryExecutor) Execute(script *Script, conns Connections, args InstanceArguments) (out RunOutput, err error) {
+	body, err := script.ScriptBody()
+	if err != nil {
+		return out, err
+	}
+	roleOptions, err := script.RoleOptions()
+	if err != nil {
+		return out, err
+	}
+	opts := pg.QueryOptions{NullString: script.NullString, RoleOptions: roleOptions, Session: script.Session}
+	if conn, exists := conns[script.Type]; exists && conn.Session.ApplicationName == "" &&
+		opts.Session.ApplicationName == "" {
+		opts.Session.ApplicationName = script.JobContext().ApplicationName()
+	}
+	qr, err := conns.Execute(script.Type, script.Role, body, script.BatchMode, opts, script.sqlStates, args)
+	return RunOutput{
+		StdOut:       qr.StdOut,
+		StdErr:       qr.StdErr,
+		CommandTags:  qr.CommandTags,
+		RowsAffected: qr.RowsAffected,
+		Rows:         qr.Rows,
+	}, err
+}
@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+type testExecutor struct{}
+
+func (te testExecutor) Verify(script Script, _ Connections) (errs []error) {
+	if script.Inline == "" {
+		errs = append(errs, fmt.Errorf("test scripts should be inline"))
+	}
+	return errs
+}
+
+func (te testExecutor) Execute(script *Script, _ Connections, args InstanceArguments) (out RunOutput, err error) {
+	out.StdOut = NewResultFromString(fmt.Sprintf("%s %s", script.Inline, args["name"]))
+	return out, nil
+}
+
+func TestScript_Yaml(t *testing.T) {
+	var command Command
+	err := yaml.Unmarshal([]byte("name: cmd\ntype: pg\ninline: select 1\nbatchMode: true\nformat: csv\n"), &command)
+	assert.NoError(t, err)
+	assert.Equal(t, Script{Name: "cmd", Type: "pg", Inline: "select 1", BatchMode: true}, command.Script)
+	assert.Equal(t, "csv", command.Format)
+}
+
+func TestGetExecutor(t *testing.T) {
+	assert.IsType(t, shellExecutor{}, GetExecutor(""))
+	assert.IsType(t, shellExecutor{}, GetExecutor("shell"))
+	assert.IsType(t, queryExecutor{}, GetExecutor("pg"))
+	assert.True(t, Script{Type: "pg"}.IsQuery())
+	assert.False(t, Script{}.IsQuery())
+	assert.Panics(t, func() { RegisterExecutor("", testExecutor{}) })
+}
+
+func TestRegisterExecutor(t *testing.T) {
+	RegisterExecutor("test", testExecutor{})
+	defer delete(executors, "test")
+	assert.Contains(t, ExecutorTypes(), "test")
+
+	command := Command{Script: Script{Name: "greet", Type: "test", Inline: "hello"}}
+	assert.Empty(t, command.Verify("step", Connections{}))
+	assert.Len(t, Command{Script: Script{Type: "test"}}.Verify("step", Connections{}), 1)
+	assert.NoError(t, command.Run(Connections{}, InstanceArguments{"name": "world"}))
+	assert.Equal(t, "hello world", command.stdOut.Text())
+
+	assert.Len(t, Connections{"test": {}}.VerifyExecutorTypes(), 1,
+		"connections cannot have the name of an executor type")
+}
+
+func TestShellExecutor(t *testing.T) {
+	script := Script{Inline: "echo $PGQ_INSTANCE_NAME; echo oops >&2; exit 3"}
+	out, err := script.Run(Connections{}, InstanceArguments{"name": "world"})
+	assert.Error(t, err)
+	assert.Equal(t, 3, out.Rc)
+	assert.Equal(t, "world", out.StdOut.Text())
+	assert.Equal(t, "oops", out.StdErr.Text())
+	assert.Empty(t, script.tmpFile, "temporary script files should be cleaned")
+}
+
+func TestScript_RoleOptions(t *testing.T) {
+	opts, err := Script{MaxLag: "1m", SyncStandbys: 2}.RoleOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, pg.RoleOptions{MaxLag: time.Minute, SyncStandbys: 2}, opts)
+	_, err = Script{MaxLag: "1 minute"}.RoleOptions()
+	assert.Error(t, err)
+	assert.Len(t, queryExecutor{}.Verify(Script{Type: "pg", Inline: "select 1", SyncStandbys: -1},
+		Connections{"pg": {}}), 1)
+}
+
+func TestJobContext_ApplicationName(t *testing.T) {
+	assert.Equal(t, "pgquartz/job/step", JobContext{Job: "job", Step: "step", Check: "check"}.ApplicationName())
+	assert.Equal(t, "pgquartz/job", JobContext{Job: "job", Check: "check"}.ApplicationName())
+}
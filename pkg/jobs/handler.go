@@ -1,27 +1,138 @@
 package jobs
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
 
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
+// Work is either an instance of a step (Step and ArgKey are set), or an instance of a check (Check is set)
 type Work struct {
 	Step   string
 	ArgKey string
+	Check  *CheckWork
+}
+
+// stepLock is the lock of a step, which is held from scheduling the step until all its instances are done
+type stepLock struct {
+	step     string
+	locker   lock.Locker
+	err      error
+	released chan struct{}
 }
 
+// Handler schedules all work of a job.
+// aborted is closed when the job is aborted (see WatchLock), after which no new work is started.
+// failure is set when the job failed (e.a. a step could not be locked), after which the job is aborted (see Failure).
+// stateLock protects the state of the steps, so that it can be read while the steps are running (see StepStates).
+// running is used to wait until all runners are done.
+// Steps with a lock are locked in the background, and are scheduled when the lock is acquired (see lockStep).
 type Handler struct {
-	Config  Config
-	Steps   Steps
-	Runners Runners
-	ToDo    chan Work
-	Done    chan Work
+	Config    Config
+	Steps     Steps
+	Runners   Runners
+	ToDo      chan Work
+	Done      chan Work
+	aborted   chan struct{}
+	abortOnce *sync.Once
+	cancel    func()
+	failure   error
+	stateLock *sync.Mutex
+	running   *sync.WaitGroup
+	locked    chan *stepLock
+	locking   map[string]bool
+	stepLocks map[string]*stepLock
 }
 
 func NewHandler(c Config) Handler {
 	return Handler{
-		Config: c,
-		Steps:  c.Steps,
-		ToDo:   make(chan Work, c.Steps.GetNumInstances()),
-		Done:   make(chan Work, c.Steps.GetNumInstances()),
+		Config:    c,
+		Steps:     c.Steps,
+		ToDo:      make(chan Work, c.Steps.GetNumInstances()),
+		Done:      make(chan Work, c.Steps.GetNumInstances()),
+		aborted:   make(chan struct{}),
+		abortOnce: &sync.Once{},
+		stateLock: &sync.Mutex{},
+		running:   &sync.WaitGroup{},
+		locked:    make(chan *stepLock, len(c.Steps)),
+		locking:   make(map[string]bool),
+		stepLocks: make(map[string]*stepLock),
+	}
+}
+
+// WatchLock watches the lock of the job (lost is closed when the lock is lost).
+// When the lock is lost and abort is true, the job is aborted: cancel is called (which cancels everything that is
+// running in the job context) and no new work is started. Otherwise, only a warning is logged.
+// cancel is also used to abort the job when the lock of a step is lost.
+func (h *Handler) WatchLock(lost <-chan struct{}, abort bool, cancel func()) {
+	h.cancel = cancel
+	if lost == nil {
+		return
 	}
+	go func() {
+		<-lost
+		if !abort {
+			log.Warn("the lock was lost while running the job, another node might be running it as well")
+			return
+		}
+		log.Error("the lock was lost while running the job, aborting")
+		h.abort()
+	}()
+}
+
+// abort aborts the job (once), so that no new work is started, and everything that is running is cancelled
+func (h *Handler) abort() {
+	h.abortOnce.Do(func() {
+		close(h.aborted)
+		if h.cancel != nil {
+			h.cancel()
+		}
+	})
+}
+
+// fail fails the job, which is aborted (see abort) and should exit with an error (see Failure)
+func (h *Handler) fail(err error) {
+	if h.failure == nil {
+		h.failure = err
+	}
+	h.abort()
+}
+
+// Failure returns the reason the job failed (e.a. a step could not be locked), or nil when it did not fail.
+// Failure should be checked (after RunSteps) before Aborted, since a failed job is aborted as well.
+func (h Handler) Failure() error {
+	return h.failure
+}
+
+// Aborted returns true when the job was aborted (see WatchLock)
+func (h Handler) Aborted() bool {
+	select {
+	case <-h.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// StepStates returns the state of all steps (by name), and can be called while the steps are running
+func (h Handler) StepStates() map[string]string {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	states := h.Steps.States()
+	for name := range h.locking {
+		states[name] = "Locking"
+	}
+	return states
+}
+
+// Close closes all connections, and should be called when the job is done
+func (h Handler) Close() {
+	log.Debug("Closing all connections")
+	h.Config.Conns.Close()
 }
 
 func (h *Handler) VerifyConfig() {
@@ -40,7 +151,7 @@ func (h Handler) VerifyRoles() error {
 		return nil
 	}
 	for _, con := range h.Config.Conns {
-		if err := con.VerifyRole(""); err != nil {
+		if err := con.VerifyRole("", pg.RoleOptions{}); err != nil {
 			return err
 		}
 	}
@@ -50,59 +161,104 @@ func (h Handler) VerifyRoles() error {
 
 func (h *Handler) RunSteps() {
 	log.Info("Initializing runners")
-	h.initRunners()
+	h.initRunners(h.Config.Parallel)
 	log.Info("Waiting for all work to be scheduled")
 	for {
-		if !h.newWork() {
+		if h.Aborted() {
+			log.Info("Job is aborted, not scheduling any more work")
+			break
+		}
+		h.stateLock.Lock()
+		h.processLocked()
+		more := h.newWork()
+		if more {
+			h.processDone()
+		}
+		h.stateLock.Unlock()
+		if !more {
 			break
 		}
-		h.processDone()
 	}
 	close(h.ToDo)
+	h.cancelLocking()
 	log.Info("Waiting for all work to be done")
-	for {
-		if h.checkAllDone() {
-			log.Debug("RunSteps: break")
-			break
+	allDone := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(allDone)
+	}()
+	for running := true; running; {
+		select {
+		case <-allDone:
+			log.Debug("RunSteps: all runners are done")
+			running = false
+		case work := <-h.Done:
+			h.stateLock.Lock()
+			h.finishWork(work)
+			h.stateLock.Unlock()
 		}
 	}
 	close(h.Done)
-	h.processDone()
+	h.stateLock.Lock()
+	for work := range h.Done {
+		h.finishWork(work)
+	}
+	h.stateLock.Unlock()
+	h.unlockSteps()
 	log.Info("All work is done")
 }
 
-func (h *Handler) RunChecks() {
+// RunChecks runs all checks and logs a summary of the results.
+// When one or more checks failed, all alerts are sent and an error is returned.
+func (h *Handler) RunChecks() error {
 	if len(h.Config.Checks) == 0 {
-		return
+		return nil
 	}
 	log.Info("Checking job results")
-	h.Config.Checks.Run(h.Config.Conns)
+	work := h.Config.Checks.Work()
+	h.ToDo = make(chan Work, len(work))
+	h.Runners = nil
+	h.initRunners(h.Config.GetChecksParallel())
+	for _, cw := range work {
+		h.ToDo <- Work{Check: cw}
+	}
+	close(h.ToDo)
+	h.running.Wait()
+	results := work.Results()
+	for _, line := range results.Table() {
+		log.Info(line)
+	}
+	if failed := results.Failed(); len(failed) > 0 {
+		err := fmt.Errorf("%d out of %d checks failed", len(failed), len(results))
+		h.Config.Alert.Send(h.Config.Conns, err.Error())
+		return err
+	}
 	log.Info("Job finished successfully")
+	return nil
 }
 
-func (h *Handler) initRunners() {
-	for i := 0; i < h.Config.Parallel; i++ {
+func (h *Handler) initRunners(parallel int) {
+	for i := 0; i < parallel; i++ {
 		r := NewRunner(h, i)
 		h.Runners = append(h.Runners, r)
+		h.running.Add(1)
 		go r.Run()
 	}
 }
 
 func (h *Handler) newWork() (done bool) {
 	for _, name := range h.Steps.GetReadySteps() {
+		if h.locking[name] {
+			continue
+		}
 		log.Infof("Scheduling step %s", name)
 		if result, err := h.Steps.CheckWhen(*h, name); err != nil {
 			log.Errorf("Error while checking step %s: %e", name, err)
 			h.Steps.setStepState(name, stepStateSkipped)
+		} else if result && h.Steps[name].Lock != nil {
+			h.lockStep(name)
 		} else if result {
-			instances := h.Steps[name].GetInstances()
-			log.Debugf("Scheduling %d instances for step %s", len(instances), name)
-			for _, i := range instances {
-				instanceName := i.Name()
-				log.Debugf("Scheduling instance [%s].[%s]", name, instanceName)
-				h.ToDo <- Work{name, instanceName}
-			}
-			h.Steps.setStepState(name, stepStateScheduled)
+			h.scheduleStep(name)
 		} else {
 			h.Steps.setStepState(name, stepStateDone)
 		}
@@ -110,18 +266,131 @@ func (h *Handler) newWork() (done bool) {
 	return h.Steps.NumWaiting() > 0
 }
 
+func (h *Handler) scheduleStep(name string) {
+	instances := h.Steps[name].GetInstances()
+	log.Debugf("Scheduling %d instances for step %s", len(instances), name)
+	for _, i := range instances {
+		instanceName := i.Name()
+		log.Debugf("Scheduling instance [%s].[%s]", name, instanceName)
+		h.ToDo <- Work{Step: name, ArgKey: instanceName}
+	}
+	h.Steps.setStepState(name, stepStateScheduled)
+}
+
+// lockStep locks the lock of a step in the background. The step stays waiting until it is locked, after which it is
+// scheduled (see processLocked).
+func (h *Handler) lockStep(name string) {
+	config := *h.Steps[name].Lock
+	h.locking[name] = true
+	locker, err := lock.NewLocker(config, h.Config.EtcdConfig, h.Config.Conns)
+	if err != nil {
+		h.locked <- &stepLock{step: name, err: err}
+		return
+	}
+	log.Infof("Locking step %s (%s lock %s)", name, config.Backend, config.Key)
+	go func() {
+		h.locked <- &stepLock{step: name, locker: locker, err: locker.Lock()}
+	}()
+}
+
+// processLocked schedules a step of which the lock is acquired. When the lock is held by someone else and onLocked
+// is skip, the step is skipped. Otherwise (e.a. a timeout, an error, or onLocked fail), the step and the job fail,
+// just like the job fails when the lock of the job could not be acquired.
+func (h *Handler) processLocked() {
+	select {
+	case sl := <-h.locked:
+		delete(h.locking, sl.step)
+		if sl.err != nil && sl.locker != nil {
+			sl.locker.Close()
+		}
+		if errors.Is(sl.err, lock.ErrLocked) && h.Steps[sl.step].Lock.SkipWhenLocked() {
+			log.Infof("Skipping step %s: %s", sl.step, sl.err)
+			h.Steps.setStepState(sl.step, stepStateSkipped)
+			return
+		} else if sl.err != nil {
+			log.Errorf("Error while locking step %s, failing the job: %e", sl.step, sl.err)
+			h.Steps.setStepState(sl.step, stepStateFailed)
+			h.fail(fmt.Errorf("could not lock step %s: %w", sl.step, sl.err))
+			return
+		}
+		log.Infof("Locked step %s", sl.step)
+		sl.released = make(chan struct{})
+		h.stepLocks[sl.step] = sl
+		h.watchStepLock(sl, h.Steps[sl.step].Lock.AbortOnLost())
+		h.scheduleStep(sl.step)
+	default:
+	}
+}
+
+// watchStepLock watches the lock of a step until it is released, and aborts the job (or warns) when it is lost
+func (h *Handler) watchStepLock(sl *stepLock, abort bool) {
+	lost := sl.locker.Lost()
+	if lost == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-sl.released:
+			return
+		case <-lost:
+		}
+		if !abort {
+			log.Warnf("the lock of step %s was lost while running the step, another node might be running it as well",
+				sl.step)
+			return
+		}
+		log.Errorf("the lock of step %s was lost while running the step, aborting", sl.step)
+		h.abort()
+	}()
+}
+
+// cancelLocking waits for all steps that are still being locked (after the job is aborted), and releases their locks
+func (h *Handler) cancelLocking() {
+	for len(h.locking) > 0 {
+		sl := <-h.locked
+		h.stateLock.Lock()
+		delete(h.locking, sl.step)
+		h.stateLock.Unlock()
+		if sl.locker != nil {
+			sl.locker.Close()
+		}
+	}
+}
+
+// unlockStep releases the lock of a step (when it has one)
+func (h *Handler) unlockStep(name string) {
+	if sl, exists := h.stepLocks[name]; exists {
+		log.Infof("Unlocking step %s", name)
+		close(sl.released)
+		sl.locker.Close()
+		delete(h.stepLocks, name)
+	}
+}
+
+// unlockSteps releases the locks of all steps that are still locked
+func (h *Handler) unlockSteps() {
+	for name := range h.stepLocks {
+		h.unlockStep(name)
+	}
+}
+
 func (h *Handler) processDone() {
 	select {
 	case doneInstance := <-h.Done:
-		if doneInstance.Step != "" {
-			log.Debugf("This step instance is done: [%s].[%s]", doneInstance.Step, doneInstance.ArgKey)
-			h.Steps.InstanceFinished(doneInstance)
-		}
+		h.finishWork(doneInstance)
 	default:
 		//log.Infof("break")
 	}
 }
 
-func (h *Handler) checkAllDone() (done bool) {
-	return h.Runners.Done()
+// finishWork processes work that is done (as sent by a runner on Done)
+func (h *Handler) finishWork(doneInstance Work) {
+	if doneInstance.Step == "" {
+		return
+	}
+	log.Debugf("This step instance is done: [%s].[%s]", doneInstance.Step, doneInstance.ArgKey)
+	h.Steps.InstanceFinished(doneInstance)
+	if h.Steps[doneInstance.Step].Instances.Done() {
+		h.unlockStep(doneInstance.Step)
+	}
 }
@@ -0,0 +1,134 @@
+package jobs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_WatchLock(t *testing.T) {
+	h := NewHandler(Config{})
+	h.WatchLock(nil, true, func() { t.Error("a nil channel should never be lost") })
+	lost := make(chan struct{})
+	cancelled := make(chan struct{})
+	h.WatchLock(lost, true, func() { close(cancelled) })
+	assert.False(t, h.Aborted())
+	close(lost)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the job context should be cancelled when the lock is lost")
+	}
+	assert.True(t, h.Aborted())
+
+	h = NewHandler(Config{})
+	lost = make(chan struct{})
+	h.WatchLock(lost, false, func() { t.Error("with onLost warn, the job should not be cancelled") })
+	close(lost)
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, h.Aborted())
+}
+
+func TestHandler_StepStates(t *testing.T) {
+	h := NewHandler(Config{Steps: Steps{
+		"prepare": &Step{state: stepStateDone},
+		"migrate": &Step{state: stepStateScheduled, Instances: Instances{
+			"1": &Instance{name: "1", done: true},
+			"2": &Instance{name: "2"},
+		}},
+		"cleanup": &Step{state: stepStateScheduled, Instances: Instances{"1": &Instance{name: "1", done: true}}},
+		"report":  &Step{state: stepStateWaiting},
+	}})
+	assert.Equal(t, map[string]string{
+		"prepare": "Done",
+		"migrate": "Scheduled",
+		"cleanup": "Done",
+		"report":  "Waiting",
+	}, h.StepStates())
+	assert.Equal(t, stepStateScheduled, h.Steps["cleanup"].state, "reading the states should not change them")
+}
+
+func TestHandler_StepLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrate.lock")
+	newHandler := func(onLocked string) Handler {
+		steps := Steps{
+			"prepare": &Step{Commands: Commands{{Script: Script{Name: "prepare", Inline: "true"}}}},
+			"migrate": &Step{
+				Commands: Commands{{Script: Script{Name: "migrate", Inline: "true"}}},
+				Depends:  []string{"prepare"},
+				Lock: &lock.Config{Backend: lock.BackendFlock, Path: path, Timeout: "200ms",
+					OnLocked: onLocked},
+			},
+			"report": &Step{
+				Commands: Commands{{Script: Script{Name: "report", Inline: "true"}}},
+				Depends:  []string{"migrate"},
+			},
+		}
+		steps.SetLockDefaults("job1", lock.Config{Backend: lock.BackendNone})
+		steps.Initialize()
+		h := NewHandler(Config{Steps: steps, Parallel: 2})
+		h.WatchLock(nil, true, func() {})
+		return h
+	}
+	h := newHandler("")
+	assert.Equal(t, "steps/job1/migrate", h.Steps["migrate"].Lock.Key)
+	h.RunSteps()
+	assert.Equal(t, map[string]string{"prepare": "Done", "migrate": "Done", "report": "Done"}, h.StepStates())
+	assert.Empty(t, h.stepLocks, "all step locks should be released when the steps are done")
+	assert.NoError(t, h.Failure())
+
+	other := lock.NewFileLocker(lock.Config{Key: "steps/job1/migrate", Path: path})
+	assert.NoError(t, other.Lock())
+	defer other.Close()
+	h = newHandler("")
+	h.RunSteps()
+	assert.Equal(t, map[string]string{"prepare": "Done", "migrate": "Failed", "report": "Waiting"}, h.StepStates(),
+		"a step that cannot be locked within the timeout should fail, and dependent steps should not run")
+	assert.Error(t, h.Failure(), "a step that cannot be locked should fail the job")
+	assert.True(t, h.Aborted())
+	h = newHandler(lock.OnLockedFail)
+	h.RunSteps()
+	assert.Equal(t, "Failed", h.StepStates()["migrate"])
+	assert.ErrorIs(t, h.Failure(), lock.ErrLocked, "with onLocked fail, a step that is locked should fail the job")
+	h = newHandler(lock.OnLockedSkip)
+	h.RunSteps()
+	assert.Equal(t, map[string]string{"prepare": "Done", "migrate": "Skipped", "report": "Done"}, h.StepStates(),
+		"with onLocked skip, a step that is locked by someone else should be skipped")
+	assert.NoError(t, h.Failure())
+	assert.False(t, h.Aborted())
+}
+
+func TestSteps_VerifyLocks(t *testing.T) {
+	jobLock := lock.Config{Backend: lock.BackendFlock, Key: "job1"}
+	steps := Steps{"migrate": &Step{Lock: &lock.Config{}}}
+	steps.SetLockDefaults("job1", jobLock)
+	assert.Empty(t, steps.VerifyLocks(jobLock, Connections{}))
+	assert.Equal(t, lock.BackendFlock, steps["migrate"].Lock.Backend)
+
+	steps["migrate"].Lock.Key = "job1"
+	assert.Len(t, steps.VerifyLocks(jobLock, Connections{}), 1, "a step cannot lock the lock of its job")
+	steps["migrate"].Lock.Key = "job1/migrate"
+	assert.Empty(t, steps.VerifyLocks(jobLock, Connections{}), "flock keys cannot be nested")
+
+	jobLock = lock.Config{Backend: lock.BackendEtcd, Key: "job1"}
+	steps = Steps{"migrate": &Step{Lock: &lock.Config{}}}
+	steps.SetLockDefaults("job1", jobLock)
+	assert.Empty(t, steps.VerifyLocks(jobLock, Connections{}), "the default key should not be nested in the job key")
+	for _, key := range []string{"job1/migrate", "job1/migrate/schema"} {
+		steps["migrate"].Lock.Key = key
+		assert.Len(t, steps.VerifyLocks(jobLock, Connections{}), 1, "etcd step key %s is nested in the job key", key)
+	}
+	steps["migrate"].Lock.Key = "job10"
+	assert.Empty(t, steps.VerifyLocks(jobLock, Connections{}))
+	jobLock.Key = "steps"
+	steps["migrate"].Lock.Key = "steps/job1/migrate"
+	assert.Len(t, steps.VerifyLocks(jobLock, Connections{}), 1, "an etcd job key should not contain step keys")
+
+	steps = Steps{"migrate": &Step{Lock: &lock.Config{}}}
+	steps.SetLockDefaults("job1", lock.Config{Backend: lock.BackendNone})
+	assert.Len(t, steps.VerifyLocks(lock.Config{Backend: lock.BackendNone}, Connections{}), 1,
+		"a step lock requires a backend")
+}
@@ -0,0 +1,232 @@
+package jobs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	executorTypeHTTP   = "http"
+	httpDefaultTimeout = 30 * time.Second
+)
+
+// HTTPBasicAuth holds the user and password for basic authentication
+type HTTPBasicAuth struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// HTTPRequest defines the request for scripts of type http.
+// The script body (inline or file) is sent as request body.
+// URL, Headers and the body can hold templated (`${name}` and `${raw:name}`) arguments, where values in the URL are
+// escaped (see expandHTTPTemplates).
+type HTTPRequest struct {
+	Method      string            `yaml:"method,omitempty"`
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	TLSCA       string            `yaml:"tlsCA,omitempty"`
+	Timeout     string            `yaml:"timeout,omitempty"`
+	BasicAuth   *HTTPBasicAuth    `yaml:"basicAuth,omitempty"`
+	BearerToken string            `yaml:"bearerToken,omitempty"`
+}
+
+func (hr HTTPRequest) GetMethod() string {
+	if hr.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(hr.Method)
+}
+
+func (hr HTTPRequest) GetTimeout() (time.Duration, error) {
+	if hr.Timeout == "" {
+		return httpDefaultTimeout, nil
+	}
+	return time.ParseDuration(hr.Timeout)
+}
+
+// Client returns a http client with the timeout and the CA of the request
+func (hr HTTPRequest) Client() (*http.Client, error) {
+	timeout, err := hr.GetTimeout()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	if hr.TLSCA == "" {
+		return client, nil
+	}
+	pem, err := os.ReadFile(hr.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in tlsCA %s", hr.TLSCA)
+	}
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+	}
+	return client, nil
+}
+
+// VerifyTemplates returns all templates in the URL, the headers and the body, that cannot be used in a http request
+func (hr HTTPRequest) VerifyTemplates(body string) (errs []error) {
+	texts := []string{hr.URL, body}
+	for _, value := range hr.Headers {
+		texts = append(texts, value)
+	}
+	for _, text := range texts {
+		for _, ta := range TemplateArguments(text) {
+			if err := verifyHTTPTemplate(ta); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// verifyHTTPTemplate returns an error for templates with an unknown format, and with the ident and literal formats,
+// which quote for SQL (and not for http)
+func verifyHTTPTemplate(ta TemplateArgument) error {
+	if err := ta.Verify(false); err != nil {
+		return err
+	} else if ta.Format == templateFormatIdent || ta.Format == templateFormatLiteral {
+		return fmt.Errorf("template %s cannot be used in a http request (use ${%s} or ${raw:%s})", ta.String(),
+			ta.Name, ta.Name)
+	}
+	return nil
+}
+
+// expandHTTPTemplates replaces all templates in a text with the values of the arguments.
+// When escape is set, values of bare templates are escaped with escape (which gets the value and the position of the
+// template in text), and `${raw:name}` can be used to paste a value as is.
+func (ias InstanceArguments) expandHTTPTemplates(text string, escape func(value string, position int) string) (
+	string, error) {
+	var expanded strings.Builder
+	last := 0
+	for _, loc := range templateRegExp.FindAllStringSubmatchIndex(text, -1) {
+		expanded.WriteString(text[last:loc[0]])
+		last = loc[1]
+		ta := TemplateArgument{Name: text[loc[4]:loc[5]]}
+		if loc[2] >= 0 {
+			ta.Format = text[loc[2]:loc[3]]
+		}
+		if err := verifyHTTPTemplate(ta); err != nil {
+			return "", err
+		}
+		value, exists := ias[ta.Name]
+		if !exists {
+			return "", fmt.Errorf("template %s references an unknown argument %s", ta.String(), ta.Name)
+		} else if escape != nil && ta.Format != templateFormatRaw {
+			value = escape(value, loc[0])
+		}
+		expanded.WriteString(value)
+	}
+	expanded.WriteString(text[last:])
+	return expanded.String(), nil
+}
+
+// expandURL expands all templates in the URL, where values are escaped for the part of the URL they are in (the path,
+// or the query), so that values with special characters (e.a. `/`, `?`, `&` or spaces) cannot change the request
+func (hr HTTPRequest) expandURL(args InstanceArguments) (string, error) {
+	query := strings.IndexByte(hr.URL, '?')
+	return args.expandHTTPTemplates(hr.URL, func(value string, position int) string {
+		if query >= 0 && position > query {
+			return url.QueryEscape(value)
+		}
+		return url.PathEscape(value)
+	})
+}
+
+// NewRequest returns the http request, with all templated arguments expanded
+func (hr HTTPRequest) NewRequest(body string, args InstanceArguments) (request *http.Request, err error) {
+	requestURL, err := hr.expandURL(args)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = args.expandHTTPTemplates(body, nil); err != nil {
+		return nil, err
+	}
+	if request, err = http.NewRequestWithContext(ctx, hr.GetMethod(), requestURL, strings.NewReader(body)); err != nil {
+		return nil, err
+	}
+	for name, value := range hr.Headers {
+		if value, err = args.expandHTTPTemplates(value, nil); err != nil {
+			return nil, err
+		}
+		request.Header.Set(name, value)
+	}
+	if hr.BasicAuth != nil {
+		request.SetBasicAuth(hr.BasicAuth.User, hr.BasicAuth.Password)
+	} else if hr.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+hr.BearerToken)
+	}
+	return request, nil
+}
+
+// httpExecutor runs scripts of type http as a http(s) request.
+// Rc is 0 for 2xx responses, and the status code for all other responses.
+type httpExecutor struct{}
+
+func (he httpExecutor) Verify(script Script, _ Connections) (errs []error) {
+	if script.HTTP == nil || script.HTTP.URL == "" {
+		return []error{fmt.Errorf("%s should have a http url", script.String())}
+	}
+	if _, err := script.HTTP.Client(); err != nil {
+		errs = append(errs, fmt.Errorf("%s has an invalid http config: %s", script.String(), err.Error()))
+	}
+	if script.HTTP.BasicAuth != nil && script.HTTP.BearerToken != "" {
+		errs = append(errs, fmt.Errorf("%s has both basicAuth and a bearerToken", script.String()))
+	}
+	var body string
+	if script.Inline != "" || script.File != "" {
+		var err error
+		if body, err = script.ScriptBody(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, err := range script.HTTP.VerifyTemplates(body) {
+		errs = append(errs, fmt.Errorf("%s: %w", script.String(), err))
+	}
+	return errs
+}
+
+func (he httpExecutor) Execute(script *Script, _ Connections, args InstanceArguments) (out RunOutput, err error) {
+	var body string
+	if script.Inline != "" || script.File != "" {
+		if body, err = script.ScriptBody(); err != nil {
+			return out, err
+		}
+	}
+	client, err := script.HTTP.Client()
+	if err != nil {
+		return out, err
+	}
+	request, err := script.HTTP.NewRequest(body, args)
+	if err != nil {
+		return out, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return out, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return out, err
+	}
+	out.StdOut = NewResultFromString(string(responseBody))
+	out.Outputs = map[string]string{"status": fmt.Sprint(response.StatusCode)}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		out.Rc = response.StatusCode
+		return out, fmt.Errorf("%s %s returned %s", request.Method, request.URL.Redacted(), response.Status)
+	}
+	return out, nil
+}
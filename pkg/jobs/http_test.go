@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPExecutor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/pause/host1" {
+			w.WriteHeader(http.StatusNotFound)
+		} else if user, password, ok := r.BasicAuth(); !ok || user != "me" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		_, _ = w.Write([]byte(r.Method + " " + r.Header.Get("X-Host") + " " + string(body)))
+	}))
+	defer server.Close()
+
+	script := Script{Type: "http", Inline: `{"host": "${host}"}`, HTTP: &HTTPRequest{
+		Method:    "post",
+		URL:       server.URL + "/pause/${host}",
+		Headers:   map[string]string{"X-Host": "${host}"},
+		BasicAuth: &HTTPBasicAuth{User: "me", Password: "secret"},
+	}}
+	assert.Empty(t, script.Verify(Connections{}))
+	out, err := script.Run(Connections{}, InstanceArguments{"host": "host1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, out.Rc)
+	assert.Equal(t, `POST host1 {"host": "host1"}`, out.StdOut.Text())
+	assert.Equal(t, "200", out.Outputs["status"])
+
+	out, err = script.Run(Connections{}, InstanceArguments{"host": "host2"})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, out.Rc, "the status code should be used as rc")
+}
+
+func TestHTTPExecutor_Escape(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.URL.Path + "|" + r.URL.Query().Get("name") + "|" + r.URL.Query().Get("x") + "|" +
+			string(body)))
+	}))
+	defer server.Close()
+
+	value := "a b/c?d=e&x=f"
+	script := Script{Type: "http", Inline: "${name}", HTTP: &HTTPRequest{
+		URL: server.URL + "/hosts/${name}?name=${name}&${raw:query}",
+	}}
+	assert.Empty(t, script.Verify(Connections{}))
+	out, err := script.Run(Connections{}, InstanceArguments{"name": value, "query": "x=y"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/hosts/"+value+"|"+value+"|y|"+value, out.StdOut.Text(),
+		"values in the url should be escaped, and the body should get the value as is")
+
+	_, err = script.Run(Connections{}, InstanceArguments{"name": value})
+	assert.Error(t, err, "unknown arguments should raise an error")
+}
+
+func TestHTTPExecutor_TLSCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	script := Script{Type: "http", HTTP: &HTTPRequest{URL: server.URL}}
+	_, err := script.Run(Connections{}, InstanceArguments{})
+	assert.Error(t, err, "the server certificate should not be trusted without tlsCA")
+
+	script.HTTP.TLSCA = filepath.Join(t.TempDir(), "ca.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(script.HTTP.TLSCA, certPem, 0600))
+	out, err := script.Run(Connections{}, InstanceArguments{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", out.StdOut.Text())
+}
+
+func TestHTTPExecutor_Verify(t *testing.T) {
+	for _, request := range []*HTTPRequest{
+		nil,
+		{},
+		{URL: "http://localhost", Timeout: "soon"},
+		{URL: "http://localhost", TLSCA: "/does/not/exist"},
+		{URL: "http://localhost", BasicAuth: &HTTPBasicAuth{}, BearerToken: "token"},
+		{URL: "http://localhost/${ident:host}"},
+		{URL: "http://localhost", Headers: map[string]string{"X-Host": "${quoted:host}"}},
+	} {
+		assert.Len(t, Script{Type: "http", HTTP: request}.Verify(Connections{}), 1)
+	}
+	script := Script{Type: "http", Inline: "${literal:host}", HTTP: &HTTPRequest{URL: "http://localhost"}}
+	assert.Len(t, script.Verify(Connections{}), 1, "sql quoting formats should be rejected in the body")
+}
@@ -1,5 +1,12 @@
 package jobs
 
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
 type Instances map[string]*Instance
 
 func (is Instances) Clone() (clone Instances) {
@@ -33,6 +40,49 @@ func (is Instances) StdErr() (r Result) {
 	return r
 }
 
+func (is Instances) CommandTags() (r Result) {
+	for _, i := range is {
+		r = append(r, i.CommandTags()...)
+	}
+	return r
+}
+
+// Rows returns the rows of all instances (sorted by instance name, to keep the order predictable)
+func (is Instances) Rows() (rows pg.Result) {
+	var names []string
+	for name := range is {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rows = rows.Append(is[name].Rows())
+	}
+	return rows
+}
+
+// Outputs returns the named outputs of all instances (sorted by instance name, so the last instance wins)
+func (is Instances) Outputs() (outputs map[string]string) {
+	var names []string
+	for name := range is {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	outputs = make(map[string]string)
+	for _, name := range names {
+		for key, value := range is[name].Outputs() {
+			outputs[key] = value
+		}
+	}
+	return outputs
+}
+
+func (is Instances) RowsAffected() (rowsAffected int64) {
+	for _, instance := range is {
+		rowsAffected += instance.RowsAffected()
+	}
+	return rowsAffected
+}
+
 func (is Instances) Rc() (rc int) {
 	for _, instance := range is {
 		rc += instance.commands.Rc()
@@ -40,26 +90,103 @@ func (is Instances) Rc() (rc int) {
 	return rc
 }
 
+// Skipped returns the number of instances that were skipped, because a pre-check failed
+func (is Instances) Skipped() (skipped int) {
+	for _, instance := range is {
+		if instance.Skipped() {
+			skipped++
+		}
+	}
+	return skipped
+}
+
+// Failed returns the number of instances that failed, because a command or a post-check failed
+func (is Instances) Failed() (failed int) {
+	for _, instance := range is {
+		if instance.Failed() {
+			failed++
+		}
+	}
+	return failed
+}
+
 type Instance struct {
-	name     string
-	args     InstanceArguments
-	commands Commands
-	done     bool
+	name       string
+	args       InstanceArguments
+	commands   Commands
+	preChecks  Checks
+	postChecks Checks
+	skipReason string
+	failReason string
+	pinSession bool
+	done       bool
 }
 
-func NewInstance(args InstanceArguments, commands Commands) *Instance {
+func NewInstance(args InstanceArguments, commands Commands, preChecks Checks, postChecks Checks) *Instance {
 	return &Instance{
-		args:     args,
-		name:     args.String(),
-		commands: commands,
+		args:       args,
+		name:       args.String(),
+		commands:   commands,
+		preChecks:  preChecks,
+		postChecks: postChecks,
 	}
 }
 
 func (i Instance) Clone() (clone *Instance) {
 	return &Instance{
-		args:     i.args.Clone(),
-		commands: i.commands.Clone(),
+		args:       i.args.Clone(),
+		name:       i.name,
+		commands:   i.commands.Clone(),
+		preChecks:  i.preChecks.Clone(),
+		postChecks: i.postChecks.Clone(),
+		pinSession: i.pinSession,
+	}
+}
+
+// Run runs the pre-checks, the commands and the post-checks of this instance (with the arguments of this instance).
+// When a pre-check fails, the commands are not run and the instance is skipped.
+// When a command or a post-check fails, the instance is marked failed.
+// With pinSession, everything runs in one session per connection (which is released when the instance is done).
+func (i *Instance) Run(conns Connections) error {
+	if i.pinSession {
+		conns = conns.Pin()
+		defer conns.Close()
+	}
+	for _, check := range i.preChecks {
+		if err := check.Run(conns, i.args); err != nil {
+			i.skipReason = fmt.Sprintf("pre-check %s failed: %s", check.String(), err.Error())
+			log.Infof("Skipping instance %s: %s", i.name, i.skipReason)
+			return nil
+		}
+	}
+	if err := i.commands.Run(conns, i.args); err != nil {
+		i.failReason = err.Error()
+		return err
+	}
+	for _, check := range i.postChecks {
+		if err := check.Run(conns, i.args); err != nil {
+			err = fmt.Errorf("post-check %s failed: %w", check.String(), err)
+			i.failReason = err.Error()
+			return err
+		}
 	}
+	return nil
+}
+
+func (i Instance) Skipped() bool {
+	return i.skipReason != ""
+}
+
+func (i Instance) SkipReason() string {
+	return i.skipReason
+}
+
+func (i Instance) Failed() bool {
+	return i.failReason != ""
+}
+
+func (i Instance) FailReason() string {
+	return i.failReason
 }
 
 func (i Instance) StdOut() (r Result) {
@@ -70,6 +197,22 @@ func (i Instance) StdErr() (r Result) {
 	return i.commands.StdErr()
 }
 
+func (i Instance) CommandTags() (r Result) {
+	return i.commands.CommandTags()
+}
+
+func (i Instance) Rows() pg.Result {
+	return i.commands.Rows()
+}
+
+func (i Instance) Outputs() map[string]string {
+	return i.commands.Outputs()
+}
+
+func (i Instance) RowsAffected() int64 {
+	return i.commands.RowsAffected()
+}
+
 func (i Instance) Name() string {
 	return i.name
 }
@@ -0,0 +1,12 @@
+package jobs
+
+import (
+	"context"
+)
+
+// ctx is the job context, which cancels running scripts when the job times out (or is aborted)
+var ctx = context.Background()
+
+func InitContext(c context.Context) {
+	ctx = c
+}
@@ -0,0 +1,18 @@
+package jobs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	InitLogger(logger.Sugar(), zap.NewAtomicLevel())
+	lock.InitLogger(logger.Sugar())
+	exitcode := m.Run()
+	_ = log.Sync()
+	os.Exit(exitcode)
+}
@@ -80,26 +80,82 @@ func (ias InstanceArguments) AsEnv() []string {
 }
 
 // ParseQuery can take a query with named arguments and convert it into a query with numbered arguments.
+// Templates (`${format:name}`) are expanded and named arguments are replaced in one pass (see ParseNamedQuery), so
+// casts, literals and comments are left untouched (except for bare `${name}` templates, see NamedQuery.Embedded), and
+// expanded values are not parsed as named arguments.
 // Inspired by https://github.com/jackc/pgx/issues/387#issuecomment-798348824
-func (ias InstanceArguments) ParseQuery(query string) (parsedQuery string, args []interface{}) {
-	var i = 1
-	parsedQuery = query
-	// Loop the named args and replace with placeholders
-	for argName, argValue := range ias {
-		if argName == "" {
-			continue
-		}
-		parsedQuery = strings.Replace(parsedQuery, fmt.Sprintf("${%s}", argName), argValue, -1)
-		if strings.Contains(parsedQuery, ":"+argName) {
-			parsedQuery = strings.ReplaceAll(parsedQuery, ":"+argName, fmt.Sprint(`$`, i))
+func (ias InstanceArguments) ParseQuery(query string) (parsedQuery string, args []interface{}, err error) {
+	if ias == nil {
+		ias = InstanceArguments{}
+	}
+	nq, err := parseQuery(query, ias)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, argName := range nq.Params {
+		if argValue, exists := ias[argName]; !exists {
+			return "", nil, fmt.Errorf("query references an unknown parameter :%s", argName)
+		} else {
 			args = append(args, argValue)
-			i++
 		}
 	}
 	// Return
 	// - the query with replaced placeholders and
 	// - an array of arguments as a []interface{} which can be directly parsed to .Query()
-	return parsedQuery, args
+	return nq.Query, args, nil
+}
+
+// VerifyQuery checks that all named arguments and templates in a query are defined in the matrix.
+// Templates with a format in literals are rejected, since they are not expanded (see NamedQuery.Unexpanded).
+// With strict set, bare templates (`${name}`) are rejected as well (also in literals and comments).
+// It returns the names of all matrix arguments that are used by the query, so callers can detect unused arguments.
+func (mas MatrixArgs) VerifyQuery(query string, strict bool) (used []string, errs []error) {
+	nq := ParseNamedQuery(query)
+	for _, ta := range nq.Templates {
+		if err := ta.Verify(strict); err != nil {
+			errs = append(errs, err)
+		} else if _, exists := mas[ta.Name]; !exists {
+			errs = append(errs, fmt.Errorf("query template %s references an unknown argument %s", ta.String(),
+				ta.Name))
+		} else {
+			used = append(used, ta.Name)
+		}
+	}
+	for _, ta := range nq.Embedded {
+		if strict {
+			errs = append(errs, fmt.Errorf("query template %s in a literal or comment is pasted as is, "+
+				"which is not allowed with strictTemplates", ta.String()))
+		} else if _, exists := mas[ta.Name]; exists {
+			used = append(used, ta.Name)
+		}
+	}
+	for _, ta := range nq.Unexpanded {
+		errs = append(errs, fmt.Errorf("query template %s in a literal is not expanded (only ${%s} is, as is)",
+			ta.String(), ta.Name))
+	}
+	for _, argName := range nq.Params {
+		if _, exists := mas[argName]; !exists {
+			errs = append(errs, fmt.Errorf("query references an unknown parameter :%s", argName))
+		} else {
+			used = append(used, argName)
+		}
+	}
+	return used, errs
+}
+
+// Unused returns the sorted names of all matrix arguments that are not in used
+func (mas MatrixArgs) Unused(used []string) (unused []string) {
+	isUsed := make(map[string]bool)
+	for _, argName := range used {
+		isUsed[argName] = true
+	}
+	for argName := range mas {
+		if !isUsed[argName] {
+			unused = append(unused, argName)
+		}
+	}
+	sort.Strings(unused)
+	return unused
 }
 
 func (mavs MatrixArgValues) Explode(key string, collected []InstanceArguments) (exploded []InstanceArguments) {
@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// pluginProtocolVersion is increased on every incompatible change of PluginRequest or PluginResponse
+const pluginProtocolVersion = 1
+
+// PluginConnection describes a Connection, so that a plugin can connect to it
+type PluginConnection struct {
+	Dsn  string `json:"dsn"`
+	Role string `json:"role,omitempty"`
+}
+
+// PluginRequest is what PgQuartz writes (as json) to stdin of an exec-plugin
+type PluginRequest struct {
+	Version     int                         `json:"version"`
+	Name        string                      `json:"name"`
+	Role        string                      `json:"role,omitempty"`
+	Body        string                      `json:"body"`
+	Args        InstanceArguments           `json:"args"`
+	Connections map[string]PluginConnection `json:"connections"`
+	Context     JobContext                  `json:"context"`
+}
+
+// PluginResponse is what an exec-plugin should write (as json) to stdout
+type PluginResponse struct {
+	Rc      int               `json:"rc"`
+	StdOut  []string          `json:"stdout"`
+	StdErr  []string          `json:"stderr"`
+	Outputs map[string]string `json:"outputs"`
+}
+
+// NewPluginRequest returns the request for running a script with an exec-plugin
+func NewPluginRequest(script Script, conns Connections, args InstanceArguments) (request PluginRequest, err error) {
+	request = PluginRequest{
+		Version:     pluginProtocolVersion,
+		Name:        script.Name,
+		Role:        script.Role,
+		Args:        args,
+		Connections: make(map[string]PluginConnection),
+		Context:     script.JobContext(),
+	}
+	if request.Args == nil {
+		request.Args = InstanceArguments{}
+	}
+	if request.Body, err = script.ScriptBody(); err != nil {
+		return request, err
+	}
+	for connName, conn := range conns {
+		request.Connections[connName] = PluginConnection{Dsn: conn.DSN(), Role: conn.Role}
+	}
+	return request, nil
+}
+
+// pluginExecutor runs an external binary (Script.Plugin), which gets a PluginRequest on stdin,
+// and should return a PluginResponse on stdout
+type pluginExecutor struct{}
+
+func (pe pluginExecutor) Verify(script Script, _ Connections) (errs []error) {
+	if script.Plugin == "" {
+		errs = append(errs, fmt.Errorf("%s should have a plugin", script.String()))
+	} else if _, err := exec.LookPath(script.Plugin); err != nil {
+		errs = append(errs, fmt.Errorf("%s has a plugin that cannot be run: %s", script.String(), err.Error()))
+	}
+	if _, err := script.ScriptBody(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (pe pluginExecutor) Execute(script *Script, conns Connections, args InstanceArguments) (out RunOutput, err error) {
+	request, err := NewPluginRequest(*script, conns, args)
+	if err != nil {
+		return out, err
+	}
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return out, err
+	}
+	exPlugin := exec.CommandContext(ctx, script.Plugin) // #nosec
+	exPlugin.Stdin = bytes.NewReader(requestJSON)
+	var stdOut, stdErr bytes.Buffer
+	exPlugin.Stdout = &stdOut
+	exPlugin.Stderr = &stdErr
+	runErr := exPlugin.Run()
+	if exitErr, ok := runErr.(*exec.ExitError); ok {
+		out.Rc = exitErr.ExitCode()
+	}
+	var response PluginResponse
+	if err = json.Unmarshal(stdOut.Bytes(), &response); err != nil {
+		// Without a valid response, everything the plugin wrote is the best we have
+		out.StdOut = NewResultFromString(stdOut.String())
+		out.StdErr = NewResultFromString(stdErr.String())
+		if runErr != nil {
+			return out, runErr
+		}
+		return out, fmt.Errorf("plugin %s returned an invalid response: %s", script.Plugin, err.Error())
+	}
+	out.Rc = response.Rc
+	out.Outputs = response.Outputs
+	for _, line := range response.StdOut {
+		out.StdOut = append(out.StdOut, ResultLine(line))
+	}
+	for _, line := range response.StdErr {
+		out.StdErr = append(out.StdErr, ResultLine(line))
+	}
+	if pluginStdErr := strings.TrimSpace(stdErr.String()); pluginStdErr != "" {
+		// Anything the plugin itself writes to stderr (e.a. logging) is kept as well
+		out.StdErr = append(out.StdErr, NewResultFromString(pluginStdErr)...)
+	}
+	if runErr != nil {
+		return out, runErr
+	} else if out.Rc != 0 {
+		return out, fmt.Errorf("plugin %s returned rc %d", script.Plugin, out.Rc)
+	}
+	return out, nil
+}
@@ -0,0 +1,65 @@
+package jobs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+	"github.com/stretchr/testify/assert"
+)
+
+func writePlugin(t *testing.T, body string) string {
+	plugin := filepath.Join(t.TempDir(), "plugin")
+	assert.NoError(t, os.WriteFile(plugin, []byte("#!/bin/bash\ncat > /dev/null\n"+body), 0700))
+	return plugin
+}
+
+func TestNewPluginRequest(t *testing.T) {
+	script := Script{Name: "backup", Type: "exec-plugin", Inline: "full", jobContext: JobContext{Job: "job", Step: "step"}}
+	conns := Connections{
+		"pg":    {ConnParams: pg.Dsn{"host": "server1", "password": "secret"}, Role: "primary"},
+		"multi": {ConnParams: pg.Dsn{}, Hosts: []string{"server1", "server2"}, Role: "standby"},
+	}
+	request, err := NewPluginRequest(script, conns, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, pluginProtocolVersion, request.Version)
+	assert.Equal(t, "full", request.Body)
+	assert.Equal(t, InstanceArguments{}, request.Args)
+	assert.Equal(t, JobContext{Job: "job", Step: "step"}, request.Context)
+	assert.Contains(t, request.Connections["pg"].Dsn, `password='secret'`, "plugins should be able to connect")
+	config, err := pgconn.ParseConfig(request.Connections["multi"].Dsn)
+	assert.NoError(t, err, "plugins should get a libpq connect string")
+	assert.Equal(t, "server1", config.Host)
+	var fallbackHosts []string
+	for _, fallback := range config.Fallbacks {
+		fallbackHosts = append(fallbackHosts, fallback.Host)
+	}
+	assert.Contains(t, fallbackHosts, "server2", "plugins should get all hosts")
+	assert.Contains(t, request.Connections["multi"].Dsn, "target_session_attrs='standby'")
+}
+
+func TestPluginExecutor(t *testing.T) {
+	script := Script{Type: "exec-plugin", Inline: "full",
+		Plugin: writePlugin(t, `echo '{"rc": 0, "stdout": ["done"], "outputs": {"backup_id": "42"}}'; echo logging >&2`)}
+	assert.Empty(t, script.Verify(Connections{}))
+	out, err := script.Run(Connections{}, InstanceArguments{})
+	assert.NoError(t, err)
+	assert.Equal(t, "done", out.StdOut.Text())
+	assert.Equal(t, "logging", out.StdErr.Text())
+	assert.Equal(t, map[string]string{"backup_id": "42"}, out.Outputs)
+
+	script.Plugin = writePlugin(t, `echo '{"rc": 2, "stderr": ["failed"]}'`)
+	out, err = script.Run(Connections{}, InstanceArguments{})
+	assert.Error(t, err)
+	assert.Equal(t, 2, out.Rc)
+	assert.Equal(t, "failed", out.StdErr.Text())
+
+	script.Plugin = writePlugin(t, `echo no json`)
+	out, err = script.Run(Connections{}, InstanceArguments{})
+	assert.Error(t, err, "an invalid response should fail")
+	assert.Equal(t, 1, out.Rc)
+
+	assert.Len(t, Script{Type: "exec-plugin", Inline: "full"}.Verify(Connections{}), 1, "a plugin is required")
+}
@@ -0,0 +1,344 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	templateFormatBare    = ""
+	templateFormatIdent   = "ident"
+	templateFormatLiteral = "literal"
+	templateFormatRaw     = "raw"
+)
+
+var (
+	templateRegExp = regexp.MustCompile(`\$\{(?:(\w+):)?(\w+)\}`)
+	// templateTokenRegExp matches a template at the start of the remainder of a query (see tokenizeQuery)
+	templateTokenRegExp = regexp.MustCompile(`^\$\{(?:(\w+):)?(\w+)\}`)
+	templateFormats     = map[string]bool{
+		templateFormatBare:    true,
+		templateFormatIdent:   true,
+		templateFormatLiteral: true,
+		templateFormatRaw:     true,
+	}
+)
+
+// TemplateArgument is a `${format:name}` reference in a query, where format is one of
+// - ident: the value is quoted as an identifier (quote_ident semantics)
+// - literal: the value is quoted as a string literal (quote_literal semantics)
+// - raw: the value is pasted as is (explicit opt-in)
+// - emptystring (`${name}`): the value is pasted as is (legacy, rejected in strict mode)
+type TemplateArgument struct {
+	Format string
+	Name   string
+}
+
+func (ta TemplateArgument) String() string {
+	if ta.Format == templateFormatBare {
+		return fmt.Sprintf("${%s}", ta.Name)
+	}
+	return fmt.Sprintf("${%s:%s}", ta.Format, ta.Name)
+}
+
+// Verify returns an error if the format is unknown, or if the format is bare and strict is set
+func (ta TemplateArgument) Verify(strict bool) error {
+	if _, exists := templateFormats[ta.Format]; !exists {
+		return fmt.Errorf("query template %s has an unknown format %s", ta.String(), ta.Format)
+	} else if strict && ta.Format == templateFormatBare {
+		return fmt.Errorf("query template %s should be specified as ${ident:%s}, ${literal:%s} or ${raw:%s}",
+			ta.String(), ta.Name, ta.Name, ta.Name)
+	}
+	return nil
+}
+
+// Expand returns the value formatted as defined by the format of the TemplateArgument
+func (ta TemplateArgument) Expand(value string) (string, error) {
+	switch ta.Format {
+	case templateFormatIdent:
+		return QuoteIdent(value), nil
+	case templateFormatLiteral:
+		return QuoteLiteral(value), nil
+	case templateFormatRaw, templateFormatBare:
+		return value, nil
+	}
+	return "", ta.Verify(false)
+}
+
+// TemplateArguments returns all `${format:name}` references in a text (e.a. an url, see HTTPRequest).
+// For queries, ParseNamedQuery should be used instead, which tells references in literals and comments apart.
+func TemplateArguments(query string) (tas []TemplateArgument) {
+	for _, match := range templateRegExp.FindAllStringSubmatch(query, -1) {
+		tas = append(tas, TemplateArgument{Format: match[1], Name: match[2]})
+	}
+	return tas
+}
+
+// QuoteIdent quotes a value as an identifier.
+// Unlike quote_ident() in PostgreSQL the value is always quoted, which is safe (also for keywords), but case-sensitive.
+func QuoteIdent(value string) string {
+	return pgx.Identifier{value}.Sanitize()
+}
+
+// QuoteLiteral quotes a value as a string literal, just like quote_literal() in PostgreSQL does
+func QuoteLiteral(value string) string {
+	value = strings.Replace(value, "'", "''", -1)
+	if strings.Contains(value, "\\") {
+		return fmt.Sprintf("E'%s'", strings.Replace(value, "\\", "\\\\", -1))
+	}
+	return fmt.Sprintf("'%s'", value)
+}
+
+// expandTemplate returns the (formatted) value of the argument that a template references
+func (ias InstanceArguments) expandTemplate(ta TemplateArgument) (string, error) {
+	if value, exists := ias[ta.Name]; !exists {
+		return "", fmt.Errorf("query template %s references an unknown argument %s", ta.String(), ta.Name)
+	} else {
+		return ta.Expand(value)
+	}
+}
+
+// NamedQuery is the result of tokenizing a query with named (`:name`) parameters.
+// Query holds the query with every named parameter replaced by a numbered ($n) placeholder.
+// Params holds the parameter names in order of first appearance, e.a. Params[0] belongs to $1.
+// Templates holds all `${format:name}` references (outside of literals and comments) in order of appearance.
+// Embedded holds all bare `${name}` references within literals and comments, which are expanded as well (for
+// backwards compatibility, e.a. `EXECUTE 'VACUUM ${schema}.t1'` in a DO block), but only when the argument exists.
+// Unexpanded holds all other `${format:name}` references within literals, which are left as is.
+type NamedQuery struct {
+	Query      string
+	Params     []string
+	Templates  []TemplateArgument
+	Embedded   []TemplateArgument
+	Unexpanded []TemplateArgument
+}
+
+// queryTokenKind is the kind of a part of a query, as found by tokenizeQuery
+type queryTokenKind int
+
+const (
+	// queryTokenText is any part of the query that is not one of the other kinds (including `::type` casts)
+	queryTokenText queryTokenKind = iota
+	// queryTokenLiteral is a string literal ('...', E'...' and $tag$...$tag$) or a quoted identifier ("...")
+	queryTokenLiteral
+	// queryTokenComment is a line comment (-- ...) or a (nested) block comment (/* ... */)
+	queryTokenComment
+	// queryTokenParam is a named parameter (:name)
+	queryTokenParam
+	// queryTokenSemicolon is a semicolon that ends a statement
+	queryTokenSemicolon
+	// queryTokenTemplate is a template (${format:name})
+	queryTokenTemplate
+)
+
+type queryToken struct {
+	kind  queryTokenKind
+	start int
+	text  string
+}
+
+// tokenizeQuery splits a query into tokens, so that named parameters and statement separators can be found without
+// being fooled by literals, quoted identifiers and comments. Adjacent text is combined into one token.
+func tokenizeQuery(query string) (tokens []queryToken) {
+	for i := 0; i < len(query); {
+		c := query[i]
+		kind, end := queryTokenText, i+1
+		switch {
+		case c == '$' && templateTokenRegExp.MatchString(query[i:]):
+			kind, end = queryTokenTemplate, i+templateTokenRegExp.FindStringIndex(query[i:])[1]
+		case c == '\'':
+			// E'...' strings support backslash escapes
+			escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i < 2 || !isIdentChar(query[i-2]))
+			kind, end = queryTokenLiteral, skipQuoted(query, i, '\'', escapes)
+		case c == '"':
+			kind, end = queryTokenLiteral, skipQuoted(query, i, '"', false)
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			kind, end = queryTokenComment, len(query)
+			if newLine := strings.IndexByte(query[i:], '\n'); newLine >= 0 {
+				end = i + newLine
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			kind, end = queryTokenComment, skipBlockComment(query, i)
+		case c == '$' && (i == 0 || !isIdentChar(query[i-1])):
+			if end = skipDollarQuoted(query, i); end > i+1 {
+				kind = queryTokenLiteral
+			}
+		case c == ':' && strings.HasPrefix(query[i:], "::"):
+			end = i + 2
+		case c == ':' && i+1 < len(query) && isIdentStart(query[i+1]) && (i == 0 || !isIdentChar(query[i-1])):
+			kind = queryTokenParam
+			for end < len(query) && isIdentChar(query[end]) {
+				end++
+			}
+		case c == ';':
+			kind = queryTokenSemicolon
+		}
+		if last := len(tokens) - 1; kind == queryTokenText && last >= 0 && tokens[last].kind == queryTokenText {
+			tokens[last].text = query[tokens[last].start:end]
+		} else {
+			tokens = append(tokens, queryToken{kind: kind, start: i, text: query[i:end]})
+		}
+		i = end
+	}
+	return tokens
+}
+
+// ParseNamedQuery tokenizes a query and only rewrites real `:name` placeholders into numbered ones.
+// The following parts of a query are left as is:
+// - type casts (`::type`)
+// - string literals ('...', E'...' and $tag$...$tag$)
+// - quoted identifiers ("...")
+// - line comments (-- ...) and (nested) block comments (/* ... */)
+// When a name is used more than once, every occurrence is replaced by the same numbered placeholder.
+// Templates are left as is (and are collected in Templates, Embedded and Unexpanded).
+func ParseNamedQuery(query string) (nq NamedQuery) {
+	nq, _ = parseQuery(query, nil)
+	return nq
+}
+
+// parseQuery rewrites named parameters into numbered placeholders (see ParseNamedQuery), and (when ias is not nil)
+// expands templates in the same pass, so that expanded values are never parsed as named parameters.
+// Within literals and comments, only bare templates of existing arguments are expanded (see NamedQuery.Embedded).
+func parseQuery(query string, ias InstanceArguments) (nq NamedQuery, err error) {
+	var parsed strings.Builder
+	numbers := make(map[string]int)
+	for _, token := range tokenizeQuery(query) {
+		switch token.kind {
+		case queryTokenTemplate:
+			submatch := templateTokenRegExp.FindStringSubmatch(token.text)
+			ta := TemplateArgument{Format: submatch[1], Name: submatch[2]}
+			nq.Templates = append(nq.Templates, ta)
+			if ias == nil {
+				parsed.WriteString(token.text)
+			} else if value, err := ias.expandTemplate(ta); err != nil {
+				return nq, err
+			} else {
+				parsed.WriteString(value)
+			}
+		case queryTokenLiteral, queryTokenComment:
+			parsed.WriteString(nq.expandEmbedded(token, ias))
+		case queryTokenParam:
+			name := token.text[1:]
+			number, exists := numbers[name]
+			if !exists {
+				nq.Params = append(nq.Params, name)
+				number = len(nq.Params)
+				numbers[name] = number
+			}
+			parsed.WriteString(fmt.Sprint(`$`, number))
+		default:
+			parsed.WriteString(token.text)
+		}
+	}
+	nq.Query = parsed.String()
+	return nq, nil
+}
+
+// expandEmbedded collects the templates within a literal or comment token, and returns the token text where the bare
+// templates of existing arguments are replaced by their value (legacy behavior, see NamedQuery.Embedded)
+func (nq *NamedQuery) expandEmbedded(token queryToken, ias InstanceArguments) string {
+	return templateRegExp.ReplaceAllStringFunc(token.text, func(match string) string {
+		submatch := templateRegExp.FindStringSubmatch(match)
+		ta := TemplateArgument{Format: submatch[1], Name: submatch[2]}
+		if ta.Format != templateFormatBare {
+			if token.kind == queryTokenLiteral {
+				nq.Unexpanded = append(nq.Unexpanded, ta)
+			}
+			return match
+		}
+		nq.Embedded = append(nq.Embedded, ta)
+		if value, exists := ias[ta.Name]; exists {
+			return value
+		}
+		return match
+	})
+}
+
+// SplitStatements splits a query into separate statements (for batchMode).
+// Semicolons in literals, quoted identifiers and comments (e.a. in a $fn$ ... $fn$ function body) do not end a
+// statement, and statements that only have whitespace and comments are left out.
+func SplitStatements(query string) (statements []string) {
+	var statement strings.Builder
+	var hasCode bool
+	for _, token := range append(tokenizeQuery(query), queryToken{kind: queryTokenSemicolon}) {
+		if token.kind != queryTokenSemicolon {
+			statement.WriteString(token.text)
+			hasCode = hasCode || token.kind != queryTokenComment && strings.TrimSpace(token.text) != ""
+			continue
+		}
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(statement.String()))
+		}
+		statement.Reset()
+		hasCode = false
+	}
+	return statements
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// skipQuoted returns the position right after the quoted part that starts at start.
+// A doubled quote character is an escaped quote, and with escapes a backslash escapes the next character.
+func skipQuoted(query string, start int, quote byte, escapes bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// skipBlockComment returns the position right after the (possibly nested) block comment that starts at start.
+func skipBlockComment(query string, start int) int {
+	depth := 0
+	for i := start; i < len(query); i++ {
+		if strings.HasPrefix(query[i:], "/*") {
+			depth++
+			i++
+		} else if strings.HasPrefix(query[i:], "*/") {
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(query)
+}
+
+// skipDollarQuoted returns the position right after the dollar quoted string that starts at start.
+// When start is not the beginning of a dollar quote (e.a. a positional parameter like $1), only the $ is skipped.
+func skipDollarQuoted(query string, start int) int {
+	end := start + 1
+	if end < len(query) && isIdentStart(query[end]) {
+		for end < len(query) && isIdentChar(query[end]) {
+			end++
+		}
+	}
+	if end >= len(query) || query[end] != '$' {
+		return start + 1
+	}
+	tag := query[start : end+1]
+	if closing := strings.Index(query[end+1:], tag); closing >= 0 {
+		return end + 1 + closing + len(tag)
+	}
+	return len(query)
+}
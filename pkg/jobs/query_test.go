@@ -0,0 +1,119 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNamedQuery(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		expected string
+		params   []string
+	}{
+		{"select :a, :b, :a", "select $1, $2, $1", []string{"a", "b"}},
+		{"select :delay::integer, :delay_ms", "select $1::integer, $2", []string{"delay", "delay_ms"}},
+		{"select ':a', E'\\':a', \":a\"", "select ':a', E'\\':a', \":a\"", nil},
+		{"select 'it''s :a', :b", "select 'it''s :a', $1", []string{"b"}},
+		{"select :a -- :b\n, :c", "select $1 -- :b\n, $2", []string{"a", "c"}},
+		{"select /* :a /* :b */ :c */ :d", "select /* :a /* :b */ :c */ $1", []string{"d"}},
+		{"do $fn$ begin perform :a; end $fn$; select $$:b$$, :c", "do $fn$ begin perform :a; end $fn$; select $$:b$$, $1",
+			[]string{"c"}},
+		{"select arr[1:n], arr[lo:hi]", "select arr[1:n], arr[lo:hi]", nil},
+	} {
+		nq := ParseNamedQuery(test.query)
+		assert.Equal(t, test.expected, nq.Query, "query %s should be parsed as expected", test.query)
+		assert.Equal(t, test.params, nq.Params, "query %s should have expected params", test.query)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	assert.Equal(t, []string{"begin", "insert into t1 values ('a;b')", "commit"},
+		SplitStatements("begin; insert into t1 values ('a;b');\ncommit;"))
+	assert.Equal(t, []string{"create function f() returns int as $fn$ begin return 1; end $fn$ language plpgsql",
+		"select f()"},
+		SplitStatements("create function f() returns int as $fn$ begin return 1; end $fn$ language plpgsql; select f()"))
+	assert.Equal(t, []string{"select 1 -- first; second", `select 2 as "a;b"`},
+		SplitStatements("select 1 -- first; second\n; /* ; */ ; select 2 as \"a;b\"; -- done"))
+}
+
+func TestInstanceArguments_ParseQuery(t *testing.T) {
+	args := InstanceArguments{"delay": "1", "delay_ms": "1000", "schema": "public"}
+	query, values, err := args.ParseQuery("select :delay_ms, :delay, :delay from ${schema}.t1")
+	assert.NoError(t, err)
+	assert.Equal(t, "select $1, $2, $2 from public.t1", query)
+	assert.Equal(t, []interface{}{"1000", "1"}, values)
+
+	_, _, err = args.ParseQuery("select :unknown")
+	assert.Error(t, err, "unknown parameters should raise an error")
+
+	args = InstanceArguments{"expr": "now()::text", "filter": "id = :id", "id": "1"}
+	query, values, err = args.ParseQuery("select ${raw:expr}, '${unknown}' /* ${unknown} */ where ${raw:filter} and :id > 0")
+	assert.NoError(t, err)
+	assert.Equal(t, "select now()::text, '${unknown}' /* ${unknown} */ where id = :id and $1 > 0", query,
+		"templates of unknown arguments in literals and comments should be left as is, and expanded values should "+
+			"not be parsed")
+	assert.Equal(t, []interface{}{"1"}, values)
+
+	args = InstanceArguments{"schema": "public"}
+	query, _, err = args.ParseQuery("select '${schema}'; do $$ begin execute 'vacuum ${schema}.t1'; end $$ -- ${schema}")
+	assert.NoError(t, err)
+	assert.Equal(t, "select 'public'; do $$ begin execute 'vacuum public.t1'; end $$ -- public", query,
+		"bare templates in literals and comments should be expanded, like before")
+	query, _, err = args.ParseQuery("select '${ident:schema}'")
+	assert.NoError(t, err)
+	assert.Equal(t, "select '${ident:schema}'", query, "templates with a format in literals should not be expanded")
+}
+
+func TestMatrixArgs_VerifyQuery(t *testing.T) {
+	mas := MatrixArgs{"a": {"1"}, "b": {"2"}, "c": {"3"}}
+	used, errs := mas.VerifyQuery("select :a, :d, ':b'", false)
+	assert.Equal(t, []string{"a"}, used)
+	assert.Len(t, errs, 1, "unknown parameter :d should be reported")
+	assert.Equal(t, []string{"b", "c"}, mas.Unused(used))
+}
+
+func TestTemplateArgument_Expand(t *testing.T) {
+	for ta, expected := range map[TemplateArgument]string{
+		{Name: "v"}:                                `it's "a" \`,
+		{Format: templateFormatRaw, Name: "v"}:     `it's "a" \`,
+		{Format: templateFormatIdent, Name: "v"}:   `"it's ""a"" \"`,
+		{Format: templateFormatLiteral, Name: "v"}: `E'it''s "a" \\'`,
+	} {
+		expanded, err := ta.Expand(`it's "a" \`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, expanded, ta.String())
+	}
+	_, err := TemplateArgument{Format: "quoted", Name: "v"}.Expand("id")
+	assert.Error(t, err, "unknown formats should raise an error")
+}
+
+func TestMatrixArgs_VerifyQueryStrict(t *testing.T) {
+	mas := MatrixArgs{"schema": {"public"}}
+	_, errs := mas.VerifyQuery("vacuum ${schema}.t1", false)
+	assert.Empty(t, errs, "bare templates are allowed when not strict")
+	_, errs = mas.VerifyQuery("vacuum ${schema}.t1", true)
+	assert.Len(t, errs, 1, "bare templates are rejected when strict")
+	used, errs := mas.VerifyQuery("vacuum ${ident:schema}.t1", true)
+	assert.Empty(t, errs, "ident templates are allowed when strict")
+	assert.Equal(t, []string{"schema"}, used)
+	_, errs = mas.VerifyQuery("vacuum ${ident:schema}.t1 -- was ${ident:schema}", true)
+	assert.Empty(t, errs, "templates with a format in comments are not expanded, and are not rejected")
+	_, errs = mas.VerifyQuery("vacuum ${ident:schema}.t1 -- was ${schema}", true)
+	assert.Len(t, errs, 1, "bare templates in comments are expanded, and are rejected when strict")
+	_, errs = mas.VerifyQuery("do $$ begin execute 'vacuum ${schema}.t1'; end $$", true)
+	assert.Len(t, errs, 1, "bare templates in literals are expanded, and are rejected when strict")
+}
+
+func TestMatrixArgs_VerifyQueryLiterals(t *testing.T) {
+	mas := MatrixArgs{"schema": {"public"}}
+	used, errs := mas.VerifyQuery("do $$ begin execute 'vacuum ${schema}.t1'; end $$", false)
+	assert.Empty(t, errs, "bare templates in literals are expanded (for backwards compatibility)")
+	assert.Equal(t, []string{"schema"}, used, "bare templates in literals should use the argument")
+	used, errs = mas.VerifyQuery("select '${HOME}'", false)
+	assert.Empty(t, errs, "bare templates in literals that are not an argument are left as is")
+	assert.Empty(t, used)
+	_, errs = mas.VerifyQuery("do $$ begin execute 'vacuum ${ident:schema}.t1'; end $$", false)
+	assert.Len(t, errs, 1, "templates with a format in literals are not expanded, which should be reported")
+}
@@ -37,6 +37,15 @@ func (r Result) String() string {
 	return fmt.Sprintf("[ %s ]", strings.Join(lines, ", "))
 }
 
+// Text returns all lines joined by newlines
+func (r Result) Text() string {
+	var lines []string
+	for _, line := range r {
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (r Result) Contains(part string) bool {
 	for _, l := range r {
 		if l.Contains(part) {
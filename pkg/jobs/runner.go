@@ -7,16 +7,6 @@ type Runner struct {
 	config Config
 	Steps  Steps
 	parent *Handler
-	done   bool
-}
-
-func (rs Runners) Done() bool {
-	for _, r := range rs {
-		if !r.done {
-			return false
-		}
-	}
-	return true
 }
 
 func NewRunner(h *Handler, index int) *Runner {
@@ -27,22 +17,30 @@ func NewRunner(h *Handler, index int) *Runner {
 	}
 }
 
+// Run runs work from the ToDo channel of the parent until it is closed (and marks the runner done with the parent)
 func (r *Runner) Run() {
+	defer r.parent.running.Done()
 	for {
 		if work, ok := <-r.parent.ToDo; !ok {
 			break
+		} else if work.Check != nil {
+			log.Debugf("Runner %d: Running check %s with arguments %s", r.index, work.Check.Result.Check,
+				work.Check.Result.Instance)
+			work.Check.Run(r.config.Conns)
 		} else if step, sExists := r.parent.Steps[work.Step]; !sExists {
 			log.Panicf("Runner %d: Trying to run a step %s that does not exist?", r.index, work.Step)
 		} else if instance, iExists := step.Instances[work.ArgKey]; !iExists {
 			log.Panicf("Runner %d: Trying to run an instance [%s].[%s] that does not exist?", r.index, work.Step, work.ArgKey)
+		} else if r.parent.Aborted() {
+			log.Infof("Runner %d: Job is aborted, not running step [%s].[%s]", r.index, work.Step, work.ArgKey)
+			r.parent.Done <- work
 		} else {
 			log.Debugf("Runner %d: Running step [%s].[%s]", r.index, work.Step, work.ArgKey)
-			if err := instance.commands.Run(r.config.Conns, instance.args); err != nil {
+			if err := instance.Run(r.config.Conns); err != nil {
 				log.Errorf("Runner %d: Error occurred while running step instance [%s].[%s]: %e", r.index, work.Step, work.ArgKey, err)
 			}
 			r.parent.Done <- work
 		}
 	}
 	log.Debugf("Runner %d: Done", r.index)
-	r.done = true
 }
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"strings"
 	"text/template"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/lock"
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
 )
 
 type stepState int
@@ -16,9 +19,13 @@ const (
 	stepStateScheduled
 	stepStateRunning
 	stepStateDone
+	stepStateFailed
 	stepStateUnknown
 )
 
+// stepLockKeyPrefix is the first part of the default key of a step lock (steps/<job>/<step>)
+const stepLockKeyPrefix = "steps"
+
 var (
 	stepStateStrings = map[stepState]string{
 		stepStateWaiting:   "Waiting",
@@ -27,6 +34,7 @@ var (
 		stepStateScheduled: "Scheduled",
 		stepStateRunning:   "Running",
 		stepStateDone:      "Done",
+		stepStateFailed:    "Failed",
 		stepStateUnknown:   "Unknown",
 	}
 )
@@ -52,9 +60,11 @@ func (ss *Steps) InstanceFinished(w Work) {
 	}
 }
 
-func (ss Steps) Verify(conns Connections) (errs []error) {
+func (ss Steps) Verify(conns Connections, strict bool) (errs []error) {
 	for stepName, step := range ss {
-		errs = append(errs, step.Commands.Verify(stepName, conns)...)
+		errs = append(errs, step.Commands.Verify(stepName, conns, step.Matrix, strict)...)
+		errs = append(errs, step.PreChecks.VerifyStepChecks(stepName, conns, step.Matrix, strict)...)
+		errs = append(errs, step.PostChecks.VerifyStepChecks(stepName, conns, step.Matrix, strict)...)
 		for _, dependency := range step.Depends {
 			if _, exists := ss[dependency]; !exists {
 				errs = append(errs, fmt.Errorf("step %s depends on unknown step %s", stepName, dependency))
@@ -64,6 +74,57 @@ func (ss Steps) Verify(conns Connections) (errs []error) {
 	return errs
 }
 
+// SetLockDefaults sets the defaults of the locks of all steps (that have a lock): the key defaults to
+// steps/<job>/<step> (so that it is not nested in the key of the job, which defaults to <job>), and all other options
+// default to those of the lock of the job (see lock.Config.Inherit)
+func (ss Steps) SetLockDefaults(jobName string, jobLock lock.Config) {
+	for stepName, step := range ss {
+		if step.Lock != nil {
+			step.Lock.Inherit(jobLock, fmt.Sprintf("%s/%s/%s", stepLockKeyPrefix, jobName, stepName))
+		}
+	}
+}
+
+// nestedLockKeys returns true when one key is the other key, or is nested in it (e.a. job1 and job1/migrate).
+// For etcd, all keys of a nested key are also keys of the lock it is nested in, so the locks would hold each other.
+func nestedLockKeys(key string, other string) bool {
+	return key == other || strings.HasPrefix(key, other+"/") || strings.HasPrefix(other, key+"/")
+}
+
+// VerifyLocks returns all issues with the locks of the steps
+func (ss Steps) VerifyLocks(jobLock lock.Config, conns Connections) (errs []error) {
+	for stepName, step := range ss {
+		if step.Lock == nil {
+			continue
+		}
+		for _, err := range step.Lock.Verify(conns) {
+			errs = append(errs, fmt.Errorf("lock of step %s: %w", stepName, err))
+		}
+		if step.Lock.Backend == "" || step.Lock.Backend == lock.BackendNone {
+			errs = append(errs, fmt.Errorf("lock of step %s requires a backend (the job has no lock backend to "+
+				"default to)", stepName))
+		} else if step.Lock.Backend == jobLock.Backend && step.Lock.Key == jobLock.Key {
+			errs = append(errs, fmt.Errorf("lock of step %s has the same key %s as the lock of the job", stepName,
+				step.Lock.Key))
+		} else if step.Lock.Backend == lock.BackendEtcd && jobLock.Backend == lock.BackendEtcd &&
+			nestedLockKeys(step.Lock.Key, jobLock.Key) {
+			errs = append(errs, fmt.Errorf("lock of step %s has key %s, which is nested in (or contains) the key %s "+
+				"of the lock of the job", stepName, step.Lock.Key, jobLock.Key))
+		}
+	}
+	return errs
+}
+
+// SetJobContext sets the job context of all commands and step checks of all steps
+func (ss Steps) SetJobContext(jobName string) {
+	for stepName, step := range ss {
+		jobContext := JobContext{Job: jobName, Step: stepName}
+		step.Commands.SetJobContext(jobContext)
+		step.PreChecks.SetJobContext(jobContext)
+		step.PostChecks.SetJobContext(jobContext)
+	}
+}
+
 func (ss *Steps) Initialize() {
 	for _, step := range *ss {
 		step.Initialize()
@@ -127,6 +188,15 @@ func (ss Steps) GetReadySteps() (ready []string) {
 	return ready
 }
 
+// States returns the state of all steps (by name)
+func (ss Steps) States() map[string]string {
+	states := make(map[string]string)
+	for name, step := range ss {
+		states[name] = step.currentState().String()
+	}
+	return states
+}
+
 func (ss Steps) NumWaiting() (numWaiting int) {
 	for _, step := range ss {
 		if !step.Waiting() {
@@ -167,12 +237,16 @@ func (ss Steps) CheckWhen(all Handler, stepName string) (bool, error) {
 }
 
 type Step struct {
-	Commands  Commands `yaml:"commands"`
-	Depends   []string `yaml:"depends,omitempty"`
-	state     stepState
-	When      []string   `yaml:"when,omitempty"`
-	Matrix    MatrixArgs `yaml:"matrix,omitempty"`
-	Instances Instances  `yaml:"-"`
+	Commands   Commands `yaml:"commands"`
+	Depends    []string `yaml:"depends,omitempty"`
+	state      stepState
+	When       []string     `yaml:"when,omitempty"`
+	Matrix     MatrixArgs   `yaml:"matrix,omitempty"`
+	PreChecks  Checks       `yaml:"preChecks,omitempty"`
+	PostChecks Checks       `yaml:"postChecks,omitempty"`
+	PinSession bool         `yaml:"pinSession,omitempty"`
+	Lock       *lock.Config `yaml:"lock,omitempty"`
+	Instances  Instances    `yaml:"-"`
 }
 
 func (s Step) Waiting() bool {
@@ -196,6 +270,15 @@ func (s *Step) Done() bool {
 	return false
 }
 
+// currentState returns the state of the step without changing it (unlike Done, which sets the state to done when
+// all instances are finished)
+func (s Step) currentState() stepState {
+	if s.state == stepStateScheduled && len(s.Instances) > 0 && s.Instances.Done() {
+		return stepStateDone
+	}
+	return s.state
+}
+
 func (s *Step) InstanceFinished(instance string) bool {
 	if s.Done() {
 		log.Fatalf("calling instanceFinished on a step that is already finished")
@@ -220,12 +303,16 @@ func (s *Step) setState(newState stepState) error {
 
 func (s Step) Clone() *Step {
 	return &Step{
-		Commands:  s.Commands.Clone(),
-		Instances: s.Instances.Clone(),
-		Depends:   s.Depends,
-		state:     stepStateWaiting,
-		When:      s.When,
-		Matrix:    s.Matrix,
+		Commands:   s.Commands.Clone(),
+		Instances:  s.Instances.Clone(),
+		Depends:    s.Depends,
+		state:      stepStateWaiting,
+		When:       s.When,
+		Matrix:     s.Matrix,
+		PreChecks:  s.PreChecks.Clone(),
+		PostChecks: s.PostChecks.Clone(),
+		PinSession: s.PinSession,
+		Lock:       s.Lock,
 	}
 }
 
@@ -241,6 +328,30 @@ func (s Step) Rc() int {
 	return s.Instances.Rc()
 }
 
+func (s Step) Skipped() int {
+	return s.Instances.Skipped()
+}
+
+func (s Step) Failed() int {
+	return s.Instances.Failed()
+}
+
+func (s Step) CommandTags() Result {
+	return s.Instances.CommandTags()
+}
+
+func (s Step) Rows() pg.Result {
+	return s.Instances.Rows()
+}
+
+func (s Step) Outputs() map[string]string {
+	return s.Instances.Outputs()
+}
+
+func (s Step) RowsAffected() int64 {
+	return s.Instances.RowsAffected()
+}
+
 func (s *Step) Initialize() {
 	s.SetInstances()
 }
@@ -251,7 +362,9 @@ func (s *Step) SetInstances() {
 	}
 	s.Instances = make(Instances)
 	for _, args := range s.Matrix.Instances() {
-		s.Instances[args.String()] = NewInstance(args, s.Commands.Clone())
+		instance := NewInstance(args, s.Commands.Clone(), s.PreChecks.Clone(), s.PostChecks.Clone())
+		instance.pinSession = s.PinSession
+		s.Instances[args.String()] = instance
 	}
 }
 
@@ -0,0 +1,94 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/holder"
+)
+
+// FileLocker locks a local file (with flock), so that a job only runs once at a time on this node
+type FileLocker struct {
+	config Config
+	file   *os.File
+}
+
+func NewFileLocker(config Config) *FileLocker {
+	return &FileLocker{config: config}
+}
+
+// LockFile returns the path of the lock file, which defaults to pgquartz_<key>.lock in the temp folder
+func (fl *FileLocker) LockFile() string {
+	if fl.config.Path != "" {
+		return fl.config.Path
+	}
+	return filepath.Join(os.TempDir(), "pgquartz_"+strings.ReplaceAll(fl.config.Key, string(os.PathSeparator), "_")+
+		".lock")
+}
+
+// Lock locks the lock file, and writes the metadata of this process (as holder of the lock) into it
+func (fl *FileLocker) Lock() (err error) {
+	path := fl.LockFile()
+	log.Debugf("locking file %s", path)
+	// #nosec G304 -- the lock file is defined in the config
+	if fl.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		return err
+	}
+	err = poll(fl.config, "lock file "+path, func() (bool, error) {
+		err := syscall.Flock(int(fl.file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return err == nil, err
+	}, fl.holder)
+	if err != nil {
+		fl.Close()
+		return err
+	}
+	if err = fl.writeHolder(); err != nil {
+		log.Errorf("error writing holder of lock file %s: %e", path, err)
+	}
+	return nil
+}
+
+func (fl *FileLocker) writeHolder() error {
+	value, err := json.Marshal(holder.New())
+	if err != nil {
+		return err
+	}
+	if err = fl.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = fl.file.WriteAt(value, 0)
+	return err
+}
+
+// holder returns a description of the process that holds the lock file
+func (fl *FileLocker) holder() string {
+	value, err := os.ReadFile(fl.LockFile())
+	if err != nil {
+		return "unknown"
+	}
+	return holder.Parse(value)
+}
+
+// Lost returns nil, since a file lock is held until the file is closed
+func (fl *FileLocker) Lost() <-chan struct{} {
+	return nil
+}
+
+func (fl *FileLocker) Close() {
+	if fl.file == nil {
+		return
+	}
+	log.Debugf("unlocking file %s", fl.file.Name())
+	// Closing the file releases the lock. The file itself is kept, since another process might be waiting for it.
+	if err := fl.file.Close(); err != nil {
+		log.Errorf("error closing lock file %s: %e", fl.file.Name(), err)
+	}
+	fl.file = nil
+}
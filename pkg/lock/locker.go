@@ -0,0 +1,239 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
+const (
+	BackendNone     = "none"
+	BackendEtcd     = "etcd"
+	BackendPostgres = "postgres"
+	BackendFlock    = "flock"
+
+	OnLostAbort = "abort"
+	OnLostWarn  = "warn"
+
+	OnLockedWait = "wait"
+	OnLockedSkip = "skip"
+	OnLockedFail = "fail"
+
+	defaultTimeout = "100h"
+	pollInterval   = 250 * time.Millisecond
+)
+
+// ErrLocked is returned by Lock (for all backends) when the lock is held by someone else, and onLocked is skip or fail
+var ErrLocked = etcd.ErrLocked
+
+// Locker makes sure that a job only runs once at a time (across all nodes that share the lock)
+type Locker interface {
+	// Lock waits until the lock is acquired, and returns an error when the lock is not acquired within the timeout
+	Lock() error
+	// Lost returns a channel that is closed when the lock is lost after it was acquired (e.a. when the etcd session
+	// expires). For backends that cannot lose the lock, the channel is nil (and is never closed).
+	Lost() <-chan struct{}
+	// Close releases the lock (when it is held) and all resources that are used for it.
+	// Close can be called more than once.
+	Close()
+}
+
+// Config defines the backend that is used for locking, and how it is used.
+// Connection is the connection for the postgres backend, and Path is the lock file for the flock backend.
+// OnLost defines what happens when the lock is lost while the job is running (abort, or warn).
+// OnLocked defines what happens when the lock is held by someone else (wait, skip, or fail).
+// MaxConcurrent overrules the maxConcurrent of the etcdConfig for the etcd backend.
+type Config struct {
+	Backend       string `yaml:"backend,omitempty"`
+	Key           string `yaml:"key,omitempty"`
+	Timeout       string `yaml:"timeout,omitempty"`
+	Connection    string `yaml:"connection,omitempty"`
+	Path          string `yaml:"path,omitempty"`
+	OnLost        string `yaml:"onLost,omitempty"`
+	OnLocked      string `yaml:"onLocked,omitempty"`
+	MaxConcurrent int    `yaml:"maxConcurrent,omitempty"`
+}
+
+// SetDefaults sets the defaults, where the etcd backend is used (for backwards compatibility) when etcdConfig is set.
+// Key and Timeout default to the lockKey and lockTimeout of etcdConfig, and to the job name and 100h.
+func (c *Config) SetDefaults(jobName string, etcdConfig etcd.Config) {
+	if c.Backend == "" {
+		if len(etcdConfig.Endpoints) > 0 || etcdConfig.LockKey != "" {
+			c.Backend = BackendEtcd
+		} else {
+			c.Backend = BackendNone
+		}
+	}
+	if c.Key == "" {
+		c.Key = etcdConfig.LockKey
+	}
+	if c.Key == "" {
+		c.Key = jobName
+	}
+	if c.Timeout == "" {
+		c.Timeout = etcdConfig.LockTimeout
+	}
+	if c.Timeout == "" {
+		c.Timeout = defaultTimeout
+	}
+}
+
+// Inherit sets the defaults for a lock within a job (e.a. the lock of a step), where the key defaults to key, and the
+// backend, timeout, connection and onLost default to those of the lock of the job (parent).
+// MaxConcurrent defaults to 1 (and not to the maxConcurrent of the job), so that the lock is a mutex by default.
+func (c *Config) Inherit(parent Config, key string) {
+	if c.Backend == "" {
+		c.Backend = parent.Backend
+	}
+	if c.Key == "" {
+		c.Key = key
+	}
+	if c.Timeout == "" {
+		c.Timeout = parent.Timeout
+	}
+	if c.Connection == "" {
+		c.Connection = parent.Connection
+	}
+	if c.OnLost == "" {
+		c.OnLost = parent.OnLost
+	}
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 1
+	}
+}
+
+// Verify returns all issues that would prevent locking
+func (c Config) Verify(conns map[string]*pg.Conn) (errs []error) {
+	switch c.Backend {
+	case "", BackendNone, BackendEtcd, BackendFlock:
+	case BackendPostgres:
+		if _, exists := conns[c.Connection]; !exists {
+			errs = append(errs, fmt.Errorf("lock backend %s requires an existing connection (not '%s')", c.Backend,
+				c.Connection))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid lock backend %s", c.Backend))
+	}
+	if c.Backend != "" && c.Backend != BackendNone && c.Key == "" {
+		errs = append(errs, fmt.Errorf("lock backend %s requires a key", c.Backend))
+	}
+	if c.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("invalid lock maxConcurrent %d", c.MaxConcurrent))
+	} else if c.MaxConcurrent > 1 && c.Backend != BackendEtcd {
+		errs = append(errs, fmt.Errorf("lock maxConcurrent %d requires backend %s (not %s)", c.MaxConcurrent,
+			BackendEtcd, c.Backend))
+	}
+	if _, err := c.GetTimeout(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid lock timeout %s: %s", c.Timeout, err.Error()))
+	}
+	switch c.OnLost {
+	case "", OnLostAbort, OnLostWarn:
+	default:
+		errs = append(errs, fmt.Errorf("invalid lock onLost %s (should be %s or %s)", c.OnLost, OnLostAbort,
+			OnLostWarn))
+	}
+	switch c.OnLocked {
+	case "", OnLockedWait, OnLockedSkip, OnLockedFail:
+	default:
+		errs = append(errs, fmt.Errorf("invalid lock onLocked %s (should be %s, %s or %s)", c.OnLocked, OnLockedWait,
+			OnLockedSkip, OnLockedFail))
+	}
+	return errs
+}
+
+// AbortOnLost returns true when the job should be aborted when the lock is lost (which is the default)
+func (c Config) AbortOnLost() bool {
+	return c.OnLost != OnLostWarn
+}
+
+// WaitWhenLocked returns true when Lock should wait for a lock that is held by someone else (which is the default)
+func (c Config) WaitWhenLocked() bool {
+	return c.OnLocked == "" || c.OnLocked == OnLockedWait
+}
+
+// SkipWhenLocked returns true when the job (or step) should be skipped when the lock is held by someone else
+func (c Config) SkipWhenLocked() bool {
+	return c.OnLocked == OnLockedSkip
+}
+
+// GetTimeout returns the maximum duration to wait for the lock
+func (c Config) GetTimeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return time.ParseDuration(defaultTimeout)
+	}
+	return time.ParseDuration(c.Timeout)
+}
+
+// EtcdConfig returns the etcdConfig for locking the lock with the etcd backend, where the key, timeout and
+// maxConcurrent (when set) of the lock overrule those of etcdConfig
+func (c Config) EtcdConfig(etcdConfig etcd.Config) etcd.Config {
+	etcdConfig.LockKey = c.Key
+	etcdConfig.LockTimeout = c.Timeout
+	if c.MaxConcurrent > 0 {
+		etcdConfig.MaxConcurrent = c.MaxConcurrent
+	}
+	return etcdConfig
+}
+
+// NewLocker returns the Locker for the backend of the config
+func NewLocker(config Config, etcdConfig etcd.Config, conns map[string]*pg.Conn) (Locker, error) {
+	if errs := config.Verify(conns); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	switch config.Backend {
+	case BackendEtcd:
+		return etcd.NewEtcdLocker(config.EtcdConfig(etcdConfig), config.WaitWhenLocked()), nil
+	case BackendPostgres:
+		return NewPgLocker(config, conns[config.Connection]), nil
+	case BackendFlock:
+		return NewFileLocker(config), nil
+	}
+	return noLocker{}, nil
+}
+
+// poll calls try until it returns true (locked), until it returns an error, or until the timeout expires.
+// This gives all backends the same timeout and onLocked semantics: the timeout only limits waiting for the lock, and
+// when the lock is held by someone else (as described by holder), poll only waits when config.WaitWhenLocked.
+func poll(config Config, description string, try func() (bool, error), holder func() string) error {
+	timeout, err := config.GetTimeout()
+	if err != nil {
+		return err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if locked, err := try(); err != nil {
+			return err
+		} else if locked {
+			return nil
+		} else if first && !config.WaitWhenLocked() {
+			return fmt.Errorf("%w: %s is held by %s", ErrLocked, description, holder())
+		} else if first {
+			log.Infof("%s is held by %s, waiting (at most %s)", description, holder(), timeout.String())
+		}
+		select {
+		case <-waitCtx.Done():
+			return fmt.Errorf("could not lock %s within %s: %w", description, timeout.String(), waitCtx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// noLocker is used for backend none, and does not lock at all
+type noLocker struct{}
+
+func (nl noLocker) Lock() error {
+	log.Debug("lock backend is none, not locking")
+	return nil
+}
+
+func (nl noLocker) Lost() <-chan struct{} {
+	return nil
+}
+
+func (nl noLocker) Close() {}
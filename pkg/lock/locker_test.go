@@ -0,0 +1,133 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/etcd"
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_SetDefaults(t *testing.T) {
+	var config Config
+	config.SetDefaults("job1", etcd.Config{})
+	assert.Equal(t, Config{Backend: BackendNone, Key: "job1", Timeout: defaultTimeout}, config,
+		"without etcdConfig, there should be no lock")
+
+	config = Config{}
+	config.SetDefaults("job1", etcd.Config{Endpoints: []string{"server1:2379"}, LockTimeout: "1m"})
+	assert.Equal(t, Config{Backend: BackendEtcd, Key: "job1", Timeout: "1m"}, config)
+
+	config = Config{Backend: BackendFlock, Timeout: "10s"}
+	config.SetDefaults("job1", etcd.Config{LockKey: "awesomeJob1"})
+	assert.Equal(t, Config{Backend: BackendFlock, Key: "awesomeJob1", Timeout: "10s"}, config)
+}
+
+func TestConfig_Verify(t *testing.T) {
+	conns := map[string]*pg.Conn{"pg": pg.NewConn(pg.Dsn{})}
+	assert.Empty(t, Config{}.Verify(conns))
+	assert.Empty(t, Config{Backend: BackendPostgres, Key: "job1", Connection: "pg"}.Verify(conns))
+	assert.Len(t, Config{Backend: BackendPostgres, Key: "job1", Connection: "other"}.Verify(conns), 1)
+	assert.Len(t, Config{Backend: "zookeeper", Key: "job1"}.Verify(conns), 1)
+	assert.Len(t, Config{Backend: BackendFlock, Timeout: "1 minute"}.Verify(conns), 2)
+	assert.Len(t, Config{OnLost: "ignore"}.Verify(conns), 1)
+	assert.Len(t, Config{OnLocked: "queue"}.Verify(conns), 1)
+	assert.Empty(t, Config{OnLocked: OnLockedSkip}.Verify(conns))
+	assert.Empty(t, Config{Backend: BackendEtcd, Key: "job1", MaxConcurrent: 2}.Verify(conns))
+	assert.Len(t, Config{Backend: BackendFlock, Key: "job1", MaxConcurrent: 2}.Verify(conns), 1,
+		"only etcd supports maxConcurrent")
+	assert.Len(t, Config{MaxConcurrent: -1}.Verify(conns), 1)
+	assert.True(t, Config{}.WaitWhenLocked())
+	assert.False(t, Config{OnLocked: OnLockedFail}.WaitWhenLocked())
+	assert.True(t, Config{OnLocked: OnLockedSkip}.SkipWhenLocked())
+	assert.True(t, Config{}.AbortOnLost())
+	assert.False(t, Config{OnLost: OnLostWarn}.AbortOnLost())
+}
+
+func TestConfig_Inherit(t *testing.T) {
+	parent := Config{Backend: BackendEtcd, Key: "job1", Timeout: "1m", OnLost: OnLostWarn, OnLocked: OnLockedSkip}
+	var config Config
+	config.Inherit(parent, "steps/job1/migrate")
+	assert.Equal(t, Config{Backend: BackendEtcd, Key: "steps/job1/migrate", Timeout: "1m", OnLost: OnLostWarn,
+		MaxConcurrent: 1}, config, "onLocked should not be inherited, and maxConcurrent should default to 1")
+	config = Config{MaxConcurrent: 3}
+	config.Inherit(parent, "steps/job1/migrate")
+	assert.Equal(t, 3, config.MaxConcurrent)
+}
+
+func TestConfig_EtcdConfig(t *testing.T) {
+	etcdConfig := etcd.Config{LockKey: "job1", LockTimeout: "1h", MaxConcurrent: 3}
+	assert.Equal(t, etcd.Config{LockKey: "job1", LockTimeout: "1h", MaxConcurrent: 3},
+		Config{Key: "job1", Timeout: "1h"}.EtcdConfig(etcdConfig))
+	var step Config
+	step.Inherit(Config{Key: "job1", Timeout: "1h"}, "steps/job1/migrate")
+	assert.Equal(t, etcd.Config{LockKey: "steps/job1/migrate", LockTimeout: "1h", MaxConcurrent: 1},
+		step.EtcdConfig(etcdConfig), "a step lock should not use the maxConcurrent of the job")
+}
+
+func TestNewLocker(t *testing.T) {
+	conns := map[string]*pg.Conn{"pg": pg.NewConn(pg.Dsn{})}
+	for backend, expected := range map[string]Locker{
+		BackendNone:     noLocker{},
+		BackendEtcd:     &etcd.Locker{},
+		BackendPostgres: &PgLocker{},
+		BackendFlock:    &FileLocker{},
+	} {
+		locker, err := NewLocker(Config{Backend: backend, Key: "job1", Connection: "pg"}, etcd.Config{}, conns)
+		assert.NoError(t, err)
+		assert.IsType(t, expected, locker, backend)
+	}
+	_, err := NewLocker(Config{Backend: BackendPostgres, Key: "job1"}, etcd.Config{}, conns)
+	assert.Error(t, err)
+}
+
+func TestFileLocker(t *testing.T) {
+	config := Config{Backend: BackendFlock, Key: "job1", Timeout: "500ms", Path: filepath.Join(t.TempDir(), "lock")}
+	first := NewFileLocker(config)
+	second := NewFileLocker(config)
+	assert.NoError(t, first.Lock())
+	assert.Nil(t, first.Lost(), "a file lock cannot be lost")
+	assert.Error(t, second.Lock(), "the lock should time out while another locker has it")
+	first.Close()
+	first.Close()
+	assert.NoError(t, second.Lock(), "the lock should be available after it is released")
+	second.Close()
+
+	assert.Equal(t, filepath.Join(os.TempDir(), "pgquartz_job_1.lock"), NewFileLocker(Config{Key: "job/1"}).LockFile())
+}
+
+func TestFileLocker_OnLocked(t *testing.T) {
+	config := Config{Backend: BackendFlock, Key: "job1", Timeout: "1h", Path: filepath.Join(t.TempDir(), "lock")}
+	first := NewFileLocker(config)
+	assert.NoError(t, first.Lock())
+	defer first.Close()
+	for _, onLocked := range []string{OnLockedSkip, OnLockedFail} {
+		config.OnLocked = onLocked
+		err := NewFileLocker(config).Lock()
+		assert.ErrorIs(t, err, ErrLocked, "with onLocked %s, Lock should not wait", onLocked)
+		assert.Contains(t, err.Error(), fmt.Sprintf("(pid %d, since", os.Getpid()),
+			"the error should describe the holder of the lock")
+	}
+}
+
+func TestPgLocker_Close(t *testing.T) {
+	// Nothing listens on port 1, so the session cannot be used, but Close should still stop watching (without
+	// reporting the lock as lost) and return
+	pg.InitContext(context.Background())
+	pl := NewPgLocker(Config{Backend: BackendPostgres, Key: "job1"}, pg.NewConn(pg.Dsn{"host": "127.0.0.1",
+		"port": "1", "connect_timeout": "1"}))
+	pl.session = pl.conn.Pin()
+	pl.lost, pl.closing, pl.watched = make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go pl.watch(pl.session, pl.lost, pl.closing, pl.watched)
+	pl.Close()
+	assert.Nil(t, pl.session)
+	select {
+	case <-pl.lost:
+		t.Error("closing should not report the lock as lost")
+	default:
+	}
+}
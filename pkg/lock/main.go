@@ -0,0 +1,20 @@
+package lock
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+var (
+	log *zap.SugaredLogger
+	ctx = context.Background()
+)
+
+func InitLogger(logger *zap.SugaredLogger) {
+	log = logger
+}
+
+func InitContext(c context.Context) {
+	ctx = c
+}
@@ -0,0 +1,136 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mannemsolutions/PgQuartz/pkg/pg"
+)
+
+const (
+	tryLockQuery = "select pg_try_advisory_lock(hashtext('pgquartz'), hashtext($1))::text"
+	unlockQuery  = "select pg_advisory_unlock(hashtext('pgquartz'), hashtext($1))::text"
+	// holderQuery describes the session that holds the advisory lock (the classid and objid of pg_locks are the
+	// unsigned representation of the two keys)
+	holderQuery = `select format('%s (pid %s, application %s, since %s)',
+	coalesce(a.client_hostname, host(a.client_addr), 'localhost'), a.pid, a.application_name, a.backend_start)
+from pg_locks l join pg_stat_activity a on a.pid = l.pid
+where l.locktype = 'advisory' and l.granted and l.objsubid = 2
+and l.classid = (hashtext('pgquartz')::bigint & 4294967295)::oid
+and l.objid = (hashtext($1)::bigint & 4294967295)::oid
+limit 1`
+	// pgWatchInterval is the interval of checking that the session (that holds the lock) is still alive, and also
+	// the maximum time that a check may take
+	pgWatchInterval = 10 * time.Second
+)
+
+// PgLocker locks a (session level) PostgreSQL advisory lock, so that a job only runs once at a time for all nodes
+// that connect to the same database.
+// The lock is held as long as the session is alive, so the session is checked periodically, and when it is lost,
+// lost is closed.
+// The session is checked without holding mutex, so watched is closed when watching stopped, after which Close can
+// use the session.
+type PgLocker struct {
+	config  Config
+	conn    *pg.Conn
+	session *pg.Conn
+	mutex   sync.Mutex
+	lost    chan struct{}
+	closing chan struct{}
+	watched chan struct{}
+}
+
+func NewPgLocker(config Config, conn *pg.Conn) *PgLocker {
+	return &PgLocker{config: config, conn: conn}
+}
+
+func (pl *PgLocker) Lock() error {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	// An advisory lock belongs to a session, so all queries should run on the same session
+	pl.session = pl.conn.Pin()
+	log.Debugf("locking advisory lock %s on connection %s", pl.config.Key, pl.config.Connection)
+	err := poll(pl.config, "advisory lock "+pl.config.Key, func() (bool, error) {
+		locked, err := pl.session.GetOneField(tryLockQuery, pl.config.Key)
+		return locked == "true", err
+	}, pl.holder)
+	if err != nil {
+		pl.session.Close()
+		pl.session = nil
+		return err
+	}
+	pl.lost = make(chan struct{})
+	pl.closing = make(chan struct{})
+	pl.watched = make(chan struct{})
+	go pl.watch(pl.session, pl.lost, pl.closing, pl.watched)
+	return nil
+}
+
+// holder returns a description of the session that holds the advisory lock (from pg_stat_activity)
+func (pl *PgLocker) holder() string {
+	holder, err := pl.session.GetOneField(holderQuery, pl.config.Key)
+	if err != nil || holder == "" {
+		return "unknown"
+	}
+	return holder
+}
+
+// watch checks the session periodically, and closes lost when the session is lost (unless closing is closed).
+// Every check has its own deadline, so that a hanging session is also detected as lost.
+// watched is closed when watch returns.
+func (pl *PgLocker) watch(session *pg.Conn, lost chan struct{}, closing chan struct{}, watched chan struct{}) {
+	defer close(watched)
+	ticker := time.NewTicker(pgWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, pgWatchInterval)
+		err := session.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			select {
+			case <-closing:
+				return
+			default:
+			}
+			log.Errorf("session holding advisory lock %s was lost: %e", pl.config.Key, err)
+			close(lost)
+			return
+		}
+	}
+}
+
+// Lost returns a channel that is closed when the session that holds the lock is lost
+func (pl *PgLocker) Lost() <-chan struct{} {
+	return pl.lost
+}
+
+func (pl *PgLocker) Close() {
+	pl.mutex.Lock()
+	closing, watched := pl.closing, pl.watched
+	pl.closing, pl.watched = nil, nil
+	pl.mutex.Unlock()
+	if closing != nil {
+		// A session cannot run queries in parallel, so wait for a running check (which takes pgWatchInterval at most)
+		close(closing)
+		<-watched
+	}
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	if pl.session == nil {
+		return
+	}
+	log.Debugf("unlocking advisory lock %s", pl.config.Key)
+	if unlocked, err := pl.session.GetOneField(unlockQuery, pl.config.Key); err != nil {
+		log.Errorf("error unlocking advisory lock %s: %e", pl.config.Key, err)
+	} else if unlocked != "true" {
+		log.Errorf("advisory lock %s was not locked anymore", pl.config.Key)
+	}
+	pl.session.Close()
+	pl.session = nil
+}
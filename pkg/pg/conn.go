@@ -1,23 +1,58 @@
 package pg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/user"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 var (
 	UnexpctedRole = fmt.Errorf("we are connected to a database with another role then wished for")
 )
 
+// SqlState returns the SQLSTATE code (e.a. 23505) of a PostgreSQL error, or emptystring for other errors
+func SqlState(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// Conn is a PostgreSQL connection endpoint.
+// Queries are run on connections from a pool (which is created on first use), and every query can use another
+// connection from the pool, unless the Conn is a pinned session (see Pin).
+// When Hosts is set, there is a pool per role (and role options), which only holds connections to hosts
+// that have that role (see RoleTargetSessionAttrs and validator).
+// MaxLag and SyncStandbys are the default RoleOptions.
+// Session holds the default SessionSettings, which are applied to every session before it is used.
+// Notices have their own lock, since they can be raised while a pool is created (with mutex locked).
 type Conn struct {
-	Type       string `yaml:"type"`
-	ConnParams Dsn    `yaml:"conn_params"`
-	Role       string `yaml:"role"`
-	conn       *pgx.Conn
+	Type         string          `yaml:"type"`
+	ConnParams   Dsn             `yaml:"conn_params"`
+	Hosts        []string        `yaml:"hosts,omitempty"`
+	Role         string          `yaml:"role"`
+	MaxLag       string          `yaml:"maxLag,omitempty"`
+	SyncStandbys int             `yaml:"syncStandbys,omitempty"`
+	MaxConns     int32           `yaml:"maxConns,omitempty"`
+	Session      SessionSettings `yaml:"session,omitempty"`
+	pools        map[target]*pgxpool.Pool
+	parent       *Conn
+	sessions     map[target]*pgxpool.Conn
+	mutex        sync.Mutex
+	noticeLock   sync.Mutex
+	notices      map[*pgconn.PgConn][]string
+	appliedLock  sync.Mutex
+	applied      map[*pgconn.PgConn]string
 }
 
 func NewConn(connParams Dsn) (c *Conn) {
@@ -26,6 +61,109 @@ func NewConn(connParams Dsn) (c *Conn) {
 	}
 }
 
+// Pin returns a Conn that runs all queries in one session (one connection from the pool of c).
+// With Hosts, this is one session per role.
+// This allows queries to share a transaction or session state (e.a. set commands and temp tables).
+// The session should be released with Close when it is no longer needed.
+func (c *Conn) Pin() *Conn {
+	return &Conn{
+		Type:         c.Type,
+		ConnParams:   c.ConnParams,
+		Hosts:        c.Hosts,
+		Role:         c.Role,
+		MaxLag:       c.MaxLag,
+		SyncStandbys: c.SyncStandbys,
+		MaxConns:     c.MaxConns,
+		Session:      c.Session,
+		parent:       c.root(),
+	}
+}
+
+// Pinned returns true when c is a pinned session (see Pin)
+func (c *Conn) Pinned() bool {
+	return c.parent != nil
+}
+
+// root returns the Conn that holds the pools (which is c itself, unless c is a pinned session)
+func (c *Conn) root() *Conn {
+	if c.parent != nil {
+		return c.parent
+	}
+	return c
+}
+
+// Close releases the sessions for a pinned session, and closes the pools (and all their connections) otherwise
+func (c *Conn) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, session := range c.sessions {
+		session.Release()
+	}
+	c.sessions = nil
+	for _, pool := range c.pools {
+		pool.Close()
+	}
+	c.pools = nil
+	if c.parent == nil {
+		c.appliedLock.Lock()
+		c.applied = nil
+		c.appliedLock.Unlock()
+		c.noticeLock.Lock()
+		c.notices = nil
+		c.noticeLock.Unlock()
+	}
+}
+
+// MultiHost returns true when the Conn has a list of hosts to select a host with the right role from
+func (c *Conn) MultiHost() bool {
+	return len(c.Hosts) > 0
+}
+
+// Verify returns all issues with the role config of the Conn
+func (c *Conn) Verify() (errs []error) {
+	if _, ok := ValidRoles[c.Role]; !ok && c.Role != "" && c.Role != RoleAll {
+		errs = append(errs, fmt.Errorf("invalid role %s", c.Role))
+	}
+	if c.MaxLag != "" {
+		if _, err := time.ParseDuration(c.MaxLag); err != nil {
+			errs = append(errs, fmt.Errorf("invalid maxLag %s: %s", c.MaxLag, err.Error()))
+		}
+	}
+	if c.SyncStandbys < 0 {
+		errs = append(errs, fmt.Errorf("invalid syncStandbys %d", c.SyncStandbys))
+	}
+	if c.Role == RoleSyncStandby && !c.MultiHost() {
+		errs = append(errs, fmt.Errorf("role %s requires hosts", RoleSyncStandby))
+	}
+	return errs
+}
+
+// roleOptions returns the options, where the options that are not set are defaulted from the Conn
+func (c *Conn) roleOptions(opts RoleOptions) RoleOptions {
+	if opts.MaxLag == 0 && c.MaxLag != "" {
+		// MaxLag is verified by Verify
+		opts.MaxLag, _ = time.ParseDuration(c.MaxLag)
+	}
+	if opts.SyncStandbys == 0 {
+		opts.SyncStandbys = c.SyncStandbys
+	}
+	return opts
+}
+
+// target returns the target of the pool that should be used for a (command) role with options.
+// Without Hosts, there is only one pool (with an empty target).
+func (c *Conn) target(role string, opts RoleOptions) target {
+	if !c.MultiHost() {
+		return target{}
+	} else if role == "" {
+		role = c.Role
+	}
+	if role == "" {
+		role = RoleAll
+	}
+	return target{role: role, opts: c.roleOptions(opts)}
+}
+
 func (c *Conn) DbName() (dbName string) {
 	value, ok := c.ConnParams["dbname"]
 	if ok {
@@ -60,37 +198,179 @@ func connectStringValue(objectName string) (escaped string) {
 	return fmt.Sprintf("'%s'", strings.Replace(objectName, "'", "\\'", -1))
 }
 
+// DSN returns the (libpq) connect string of the Conn, which includes the Hosts (and target_session_attrs) for
+// the role of the Conn
 func (c *Conn) DSN() (dsn string) {
-	var pairs []string
+	return c.dsn(c.target("", RoleOptions{}))
+}
+
+// dsn returns the connect string for a pool target.
+// With Hosts, the hosts (and ports) are added, and target_session_attrs is set to connect to a host with that role.
+func (c *Conn) dsn(t target) (dsn string) {
+	params := make(Dsn)
 	for key, value := range c.ConnParams {
+		params[key] = value
+	}
+	if c.MultiHost() {
+		defaultPort, exists := params["port"]
+		if !exists {
+			defaultPort = "5432"
+		}
+		var hosts, ports []string
+		for _, hostPort := range c.Hosts {
+			host, port := splitHostPort(hostPort, defaultPort)
+			hosts = append(hosts, host)
+			ports = append(ports, port)
+		}
+		params["host"] = strings.Join(hosts, ",")
+		params["port"] = strings.Join(ports, ",")
+		params["target_session_attrs"] = RoleTargetSessionAttrs[t.role]
+	}
+	var pairs []string
+	for key, value := range params {
 		pairs = append(pairs, fmt.Sprintf("%s=%s", key, connectStringValue(value)))
 	}
 	return strings.Join(pairs[:], " ")
 }
 
+// splitHostPort splits a host from Hosts (e.a. `server1:5433`, `[::1]:5433` or `::1`) into a host and a port.
+// IPv6 addresses can only have a port when enclosed in brackets, and the brackets are removed (as libpq expects).
+func splitHostPort(hostPort string, defaultPort string) (host string, port string) {
+	if strings.HasPrefix(hostPort, "[") {
+		if end := strings.Index(hostPort, "]"); end > 0 {
+			host, rest := hostPort[1:end], hostPort[end+1:]
+			if strings.HasPrefix(rest, ":") && len(rest) > 1 {
+				return host, rest[1:]
+			}
+			return host, defaultPort
+		}
+	}
+	if strings.Count(hostPort, ":") == 1 {
+		i := strings.Index(hostPort, ":")
+		return hostPort[:i], hostPort[i+1:]
+	}
+	return hostPort, defaultPort
+}
+
+// Connect creates the default pool (when it does not exist yet)
 func (c *Conn) Connect() (err error) {
-	if c.conn != nil {
-		if c.conn.IsClosed() {
-			c.conn = nil
-		} else {
-			return nil
+	_, err = c.pool(c.target("", RoleOptions{}))
+	return err
+}
+
+// pool returns the pool for a target, and creates it when it does not exist yet.
+// With Hosts, pgx only connects to hosts that have the role (with options), and every connection is verified to
+// (still) have the role before it is used (see validator), so that after a failover (or when a standby lags too
+// much) the pool connects to a host that has the role.
+// Pools connect lazily, so that validators can use other pools (e.a. the primary pool for syncStandby).
+func (c *Conn) pool(t target) (pool *pgxpool.Pool, err error) {
+	root := c.root()
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	if pool, exists := root.pools[t]; exists {
+		return pool, nil
+	}
+	var poolConfig *pgxpool.Config
+	if poolConfig, err = pgxpool.ParseConfig(root.dsn(t)); err != nil {
+		return nil, err
+	}
+	if root.MaxConns > 0 {
+		poolConfig.MaxConns = root.MaxConns
+	}
+	poolConfig.LazyConnect = true
+	poolConfig.ConnConfig.OnNotice = root.onNotice
+	if validate := root.validator(t); validate != nil {
+		poolConfig.ConnConfig.ValidateConnect = validate
+		poolConfig.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+			if err := validate(ctx, conn.PgConn()); err != nil {
+				log.Infof("dropping connection to %s, which no longer has role %s: %s", conn.PgConn().Conn().RemoteAddr(),
+					t.role, err.Error())
+				root.forgetSession(conn.PgConn())
+				return false
+			}
+			return true
 		}
 	}
-	c.conn, err = pgx.Connect(ctx, c.DSN())
+	if pool, err = pgxpool.ConnectConfig(ctx, poolConfig); err != nil {
+		return nil, err
+	}
+	if root.pools == nil {
+		root.pools = make(map[target]*pgxpool.Pool)
+	}
+	root.pools[t] = pool
+	return pool, nil
+}
+
+// acquire returns a connection (to a host with the role, and with the session settings applied) to run queries on,
+// and a function that should be called when done with it.
+func (c *Conn) acquire(opts QueryOptions) (conn *pgxpool.Conn, release func(), err error) {
+	if conn, release, err = c.acquireSession(c.target(opts.Role, opts.RoleOptions)); err != nil {
+		return nil, nil, err
+	}
+	if err = c.applySession(conn.Conn().PgConn(), c.sessionSettings(opts.Session)); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return conn, release, nil
+}
+
+// acquireSession returns a connection from the pool of the target.
+// For a pinned session, this is always the same connection (which is released by Close).
+func (c *Conn) acquireSession(t target) (conn *pgxpool.Conn, release func(), err error) {
+	pool, err := c.pool(t)
 	if err != nil {
-		c.conn = nil
-		return err
+		return nil, nil, err
 	}
-	return nil
+	if c.parent == nil {
+		if conn, err = pool.Acquire(ctx); err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.Release, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if session, exists := c.sessions[t]; exists {
+		return session, func() {}, nil
+	}
+	if conn, err = pool.Acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	if c.sessions == nil {
+		c.sessions = make(map[target]*pgxpool.Conn)
+	}
+	c.sessions[t] = conn
+	return conn, func() {}, nil
+}
+
+// onNotice collects server notices (RAISE NOTICE, VACUUM VERBOSE, etc.) formatted as psql would print them.
+// Notices are collected per connection, since queries can run on multiple connections of the pool in parallel.
+func (c *Conn) onNotice(pgConn *pgconn.PgConn, notice *pgconn.Notice) {
+	c.noticeLock.Lock()
+	defer c.noticeLock.Unlock()
+	if c.notices == nil {
+		c.notices = make(map[*pgconn.PgConn][]string)
+	}
+	c.notices[pgConn] = append(c.notices[pgConn], fmt.Sprintf("%s:  %s", notice.Severity, notice.Message))
+}
+
+// takeNotices returns (and forgets) all notices that were collected for a connection
+func (c *Conn) takeNotices(pgConn *pgconn.PgConn) (notices []string) {
+	root := c.root()
+	root.noticeLock.Lock()
+	defer root.noticeLock.Unlock()
+	notices = root.notices[pgConn]
+	delete(root.notices, pgConn)
+	return notices
 }
 
 func (c *Conn) CheckExists(query string, args ...interface{}) (exists bool, err error) {
-	err = c.Connect()
+	conn, release, err := c.acquire(QueryOptions{Role: c.Role})
 	if err != nil {
 		return false, err
 	}
+	defer release()
 	var answer string
-	err = c.conn.QueryRow(ctx, query, args...).Scan(&answer)
+	err = conn.QueryRow(ctx, query, args...).Scan(&answer)
 	if err == pgx.ErrNoRows {
 		return false, nil
 	}
@@ -101,70 +381,132 @@ func (c *Conn) CheckExists(query string, args ...interface{}) (exists bool, err
 }
 
 func (c *Conn) Exec(query string, args ...interface{}) (err error) {
-	err = c.Connect()
+	conn, release, err := c.acquire(QueryOptions{Role: c.Role})
 	if err != nil {
 		return err
 	}
-	_, err = c.conn.Exec(ctx, query, args...)
+	defer release()
+	_, err = conn.Exec(ctx, query, args...)
 	return err
 }
 
+// Ping checks that the session is alive, where pingCtx can limit how long the check may take
+func (c *Conn) Ping(pingCtx context.Context) error {
+	conn, release, err := c.acquire(QueryOptions{Role: c.Role})
+	if err != nil {
+		return err
+	}
+	defer release()
+	return conn.Ping(pingCtx)
+}
+
 func (c *Conn) GetOneField(query string, args ...interface{}) (answer string, err error) {
-	err = c.Connect()
+	conn, release, err := c.acquire(QueryOptions{Role: c.Role})
 	if err != nil {
 		return "", err
 	}
+	defer release()
 
-	err = c.conn.QueryRow(ctx, query, args...).Scan(&answer)
+	err = conn.QueryRow(ctx, query, args...).Scan(&answer)
 	if err != nil {
 		return "", fmt.Errorf("runQueryGetOneField (%s) failed: %v\n", query, err)
 	}
 	return answer, nil
 }
 
-func (c *Conn) GetAll(query string, args ...interface{}) (answer Result, err error) {
-	err = c.Connect()
+// QueryOptions controls how GetAll runs a query and renders the result
+type QueryOptions struct {
+	// NullString is used to render NULL values (psql renders NULL as emptystring by default)
+	NullString string
+	// Role (and RoleOptions) select the host to run the query on, when the Conn has Hosts
+	// (defaults to the Role of the Conn)
+	Role string
+	RoleOptions
+	// Session overrules the SessionSettings of the Conn
+	Session SessionSettings
+}
+
+// GetAll runs a query and returns all rows, together with the command tag and all notices raised by the server.
+// Notices are also returned when the query fails.
+// All values are returned in PostgreSQL text format (exactly like psql would show them), and NULL values are
+// rendered as opts.NullString.
+func (c *Conn) GetAll(opts QueryOptions, query string, args ...interface{}) (answer Result, err error) {
+	conn, release, err := c.acquire(opts)
 	if err != nil {
 		return answer, err
 	}
+	defer release()
+	pgConn := conn.Conn().PgConn()
+	c.takeNotices(pgConn)
+	defer func() {
+		answer.notices = c.takeNotices(pgConn)
+	}()
 	var cursor pgx.Rows
-	if cursor, err = c.conn.Query(ctx, query, args...); err != nil {
+	// An empty QueryResultFormatsByOID requests text format for all result columns
+	args = append([]interface{}{pgx.QueryResultFormatsByOID{}}, args...)
+	if cursor, err = conn.Query(ctx, query, args...); err != nil {
 		return answer, err
 	} else {
+		defer cursor.Close()
+		var names []string
 		for _, header := range cursor.FieldDescriptions() {
-			answer.header = append(answer.header, string(header.Name))
+			names = append(names, string(header.Name))
 		}
+		answer.header = uniqueNames(names)
 		for cursor.Next() {
 			var row []string
-			var cols []interface{}
-			if cols, err = cursor.Values(); err != nil {
-				return answer, err
-			} else {
-				for _, col := range cols {
-					row = append(row, fmt.Sprint(col))
+			for _, col := range cursor.RawValues() {
+				if col == nil {
+					row = append(row, opts.NullString)
+				} else {
+					row = append(row, string(col))
 				}
 			}
 			answer.rows = append(answer.rows, row)
 		}
+		if err = cursor.Err(); err != nil {
+			return answer, err
+		}
+		answer.commandTag = cursor.CommandTag()
 	}
 	return answer, nil
 }
 
-func (c *Conn) VerifyRole(expected string) error {
+// VerifyRole verifies that the Conn can be used for a role (with options).
+// Without Hosts, UnexpctedRole is returned when the host does not have the role.
+// With Hosts, an error is returned when none of the hosts has the role.
+func (c *Conn) VerifyRole(expected string, opts RoleOptions) error {
 	if expected == "" {
 		expected = c.Role
 	}
-	if expected == "all" {
+	if expected == RoleAll {
 		return nil
 	}
 	if _, ok := ValidRoles[expected]; !ok {
 		return fmt.Errorf("invalid role was specified for conn %s", c.ConnParams.String(true))
 	}
-	if role, err := c.GetOneField("select case pg_is_in_recovery() when true then 'standby' else 'primary' end"); err != nil {
+	if c.MultiHost() {
+		// Verifying means that we can connect to a host with the expected role
+		_, release, err := c.acquire(QueryOptions{Role: expected, RoleOptions: opts})
+		if err != nil {
+			return fmt.Errorf("could not connect to a host with role %s: %w", expected, err)
+		}
+		release()
+		return nil
+	} else if expected == RolePreferStandby {
+		return nil
+	}
+	conn, release, err := c.acquire(QueryOptions{})
+	if err != nil {
 		return err
-	} else if role != expected {
-		log.Debugf("actual role %s != expected role %s", role, expected)
+	}
+	defer release()
+	validate := c.validator(target{role: expected, opts: c.roleOptions(opts)})
+	if err = validate(ctx, conn.Conn().PgConn()); errors.Is(err, errRoleMismatch) {
+		log.Debugf("host does not have expected role %s: %s", expected, err.Error())
 		return UnexpctedRole
+	} else if err != nil {
+		return err
 	}
 	log.Debugf("actual role is as expected %s", expected)
 	return nil
@@ -0,0 +1,125 @@
+package pg
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_Pin(t *testing.T) {
+	c := NewConn(Dsn{"host": "server1"})
+	c.MaxConns = 2
+	pinned := c.Pin()
+	assert.Same(t, c, pinned.root(), "a pinned session should use the pool of its parent")
+	assert.True(t, pinned.Pinned())
+	assert.False(t, c.Pinned())
+	assert.Same(t, c, pinned.Pin().root(), "pinning a pinned session should use the same pool")
+	assert.Equal(t, c.ConnParams, pinned.ConnParams)
+	assert.Equal(t, c.MaxConns, pinned.MaxConns)
+	// Closing without a pool or session should be harmless
+	pinned.Close()
+	c.Close()
+}
+
+func TestConn_Notices(t *testing.T) {
+	c := NewConn(Dsn{})
+	conn1, conn2 := &pgconn.PgConn{}, &pgconn.PgConn{}
+	c.onNotice(conn1, &pgconn.Notice{Severity: "NOTICE", Message: "one"})
+	c.onNotice(conn2, &pgconn.Notice{Severity: "WARNING", Message: "two"})
+	assert.Equal(t, []string{"NOTICE:  one"}, c.Pin().takeNotices(conn1), "notices are kept per connection")
+	assert.Empty(t, c.takeNotices(conn1), "notices should only be returned once")
+	assert.Equal(t, []string{"WARNING:  two"}, c.takeNotices(conn2))
+}
+
+func TestConn_DSN(t *testing.T) {
+	c := NewConn(Dsn{"port": "5433", "dbname": "postgres"})
+	assert.NotContains(t, c.dsn(target{}), "target_session_attrs",
+		"single host connections should not set target_session_attrs")
+	assert.Equal(t, target{}, c.target(RolePrimary, RoleOptions{}), "single host connections have only one pool")
+
+	c.Hosts = []string{"server1", "server2:5434", "[::1]", "[fe80::2]:5435", "fe80::3"}
+	c.Role = RoleStandby
+	dsn := c.dsn(c.target("", RoleOptions{}))
+	assert.Contains(t, dsn, "host='server1,server2,::1,fe80::2,fe80::3'")
+	assert.Contains(t, dsn, "port='5433,5434,5433,5435,5433'")
+	assert.Contains(t, dsn, "target_session_attrs='standby'")
+	assert.Equal(t, RolePrimary, c.target(RolePrimary, RoleOptions{}).role)
+	c.Role = ""
+	assert.Equal(t, RoleAll, c.target("", RoleOptions{}).role)
+	assert.Contains(t, c.dsn(target{role: RolePreferStandby}), "target_session_attrs='prefer-standby'")
+	assert.Contains(t, c.dsn(target{role: RoleSyncStandby}), "target_session_attrs='standby'")
+
+	c.Hosts = []string{"server1", "server2:5434"}
+	config, err := pgconn.ParseConfig(c.dsn(target{role: RolePrimary}))
+	assert.NoError(t, err)
+	assert.Equal(t, "server1", config.Host)
+	var fallbackHosts []string
+	for _, fallback := range config.Fallbacks {
+		fallbackHosts = append(fallbackHosts, fmt.Sprintf("%s:%d", fallback.Host, fallback.Port))
+	}
+	assert.Contains(t, fallbackHosts, "server2:5434", "pgx should try all hosts")
+
+	c.Hosts = []string{"[::1]:5434", "fe80::2"}
+	config, err = pgconn.ParseConfig(c.dsn(target{role: RolePrimary}))
+	assert.NoError(t, err, "IPv6 hosts should result in a valid connect string")
+	assert.Equal(t, "::1", config.Host)
+	assert.Equal(t, uint16(5434), config.Port)
+	fallbackHosts = nil
+	for _, fallback := range config.Fallbacks {
+		fallbackHosts = append(fallbackHosts, fmt.Sprintf("%s:%d", fallback.Host, fallback.Port))
+	}
+	assert.Contains(t, fallbackHosts, "fe80::2:5433")
+	assert.NotNil(t, config.ValidateConnect, "pgx should validate the role of the host")
+}
+
+func TestSplitHostPort(t *testing.T) {
+	for hostPort, expected := range map[string][2]string{
+		"server1":        {"server1", "5432"},
+		"server1:5433":   {"server1", "5433"},
+		"10.0.0.1:5433":  {"10.0.0.1", "5433"},
+		"::1":            {"::1", "5432"},
+		"fe80::1:5433":   {"fe80::1:5433", "5432"},
+		"[::1]":          {"::1", "5432"},
+		"[fe80::1]:5433": {"fe80::1", "5433"},
+	} {
+		host, port := splitHostPort(hostPort, "5432")
+		assert.Equal(t, expected, [2]string{host, port}, hostPort)
+	}
+}
+
+func TestConn_RoleOptions(t *testing.T) {
+	c := NewConn(Dsn{})
+	c.Hosts = []string{"server1", "server2"}
+	c.MaxLag = "30s"
+	c.SyncStandbys = 2
+	assert.Equal(t, RoleOptions{MaxLag: 30 * time.Second, SyncStandbys: 2},
+		c.target(RoleStandby, RoleOptions{}).opts, "options should default to those of the connection")
+	assert.Equal(t, RoleOptions{MaxLag: time.Minute, SyncStandbys: 1},
+		c.target(RoleStandby, RoleOptions{MaxLag: time.Minute, SyncStandbys: 1}).opts)
+	assert.NotEqual(t, c.target(RoleStandby, RoleOptions{}), c.target(RoleStandby, RoleOptions{MaxLag: time.Minute}),
+		"every role option should have its own pool")
+
+	assert.Nil(t, c.validator(target{role: RoleAll}))
+	assert.Nil(t, c.validator(target{role: RolePreferStandby}))
+	for _, role := range []string{RolePrimary, RolePrimaryWithSyncStandbys, RoleStandby, RoleSyncStandby} {
+		assert.NotNil(t, c.validator(target{role: role}), role)
+	}
+}
+
+func TestConn_Verify(t *testing.T) {
+	c := NewConn(Dsn{})
+	assert.Empty(t, c.Verify())
+	c.Role = "secondary"
+	c.MaxLag = "30 seconds"
+	c.SyncStandbys = -1
+	assert.Len(t, c.Verify(), 3)
+	c.Role = RoleSyncStandby
+	c.MaxLag = "30s"
+	c.SyncStandbys = 1
+	assert.Len(t, c.Verify(), 1, "syncStandby requires hosts")
+	c.Hosts = []string{"server1", "server2"}
+	assert.Empty(t, c.Verify())
+}
@@ -6,12 +6,33 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	RolePrimary                 = "primary"
+	RolePrimaryWithSyncStandbys = "primaryWithSyncStandbys"
+	RoleStandby                 = "standby"
+	RoleSyncStandby             = "syncStandby"
+	RolePreferStandby           = "preferStandby"
+	RoleAll                     = "all"
+)
+
 var (
 	log        *zap.SugaredLogger
 	ctx        context.Context
 	ValidRoles = map[string]bool{
-		"primary": true,
-		"standby": true,
+		RolePrimary:                 true,
+		RolePrimaryWithSyncStandbys: true,
+		RoleStandby:                 true,
+		RoleSyncStandby:             true,
+		RolePreferStandby:           true,
+	}
+	// RoleTargetSessionAttrs maps roles to target_session_attrs, which is used to select a host from a list of hosts
+	RoleTargetSessionAttrs = map[string]string{
+		RolePrimary:                 "primary",
+		RolePrimaryWithSyncStandbys: "primary",
+		RoleStandby:                 "standby",
+		RoleSyncStandby:             "standby",
+		RolePreferStandby:           "prefer-standby",
+		RoleAll:                     "any",
 	}
 )
 
@@ -0,0 +1,165 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+const (
+	lagQuery = `select case when not exists (select 1 from pg_stat_wal_receiver where status = 'streaming') then null
+when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+else coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0) end`
+	walReceiverNameQuery = `select coalesce(substring(conninfo from 'application_name=([^ ]+)'),
+nullif(current_setting('cluster_name'), ''), 'walreceiver') from pg_stat_wal_receiver`
+	syncStandbyQuery  = `select count(*) from pg_stat_replication where application_name = $1 and sync_state in ('sync', 'quorum')`
+	syncStandbysQuery = `select count(*) from pg_stat_replication where sync_state in ('sync', 'quorum')`
+)
+
+// errRoleMismatch is wrapped by all errors that mean that a host does not have the expected role
+var errRoleMismatch = errors.New("role mismatch")
+
+// RoleOptions refine the requirements for a role
+type RoleOptions struct {
+	// MaxLag is the maximum replication lag for standby and syncStandby (0 means no maximum)
+	MaxLag time.Duration
+	// SyncStandbys is the minimum number of sync standbys for primaryWithSyncStandbys (0 means 1)
+	SyncStandbys int
+}
+
+// target is what a pool connects to: a role (only with Hosts) and the options for that role
+type target struct {
+	role string
+	opts RoleOptions
+}
+
+// queryValue runs a query (without arguments) and returns the first column of the first row
+func queryValue(ctx context.Context, pgConn *pgconn.PgConn, query string) (value string, err error) {
+	result := pgConn.ExecParams(ctx, query, nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return "", result.Err
+	} else if len(result.Rows) == 0 || result.Rows[0][0] == nil {
+		return "", nil
+	}
+	return string(result.Rows[0][0]), nil
+}
+
+func verifyRecovery(ctx context.Context, pgConn *pgconn.PgConn, expected bool) error {
+	inRecovery, err := queryValue(ctx, pgConn, "select pg_is_in_recovery()")
+	if err != nil {
+		return err
+	} else if expected && inRecovery != "t" {
+		return fmt.Errorf("%w: server is not a standby", errRoleMismatch)
+	} else if !expected && inRecovery == "t" {
+		return fmt.Errorf("%w: server is not a primary", errRoleMismatch)
+	}
+	return nil
+}
+
+func verifyLag(ctx context.Context, pgConn *pgconn.PgConn, maxLag time.Duration) error {
+	if maxLag == 0 {
+		return nil
+	}
+	lagValue, err := queryValue(ctx, pgConn, lagQuery)
+	if err != nil {
+		return err
+	}
+	return checkLag(lagValue, maxLag)
+}
+
+// checkLag checks the outcome of lagQuery, which is NULL (emptystring) when the standby is not streaming.
+// A standby that is not streaming (e.a. when the primary is unreachable) can lag any amount, which is unknown.
+func checkLag(lagValue string, maxLag time.Duration) error {
+	if lagValue == "" {
+		return fmt.Errorf("%w: standby is not streaming, so the lag is unknown", errRoleMismatch)
+	}
+	lagSeconds, err := strconv.ParseFloat(lagValue, 64)
+	if err != nil {
+		return err
+	}
+	if lag := time.Duration(lagSeconds * float64(time.Second)); lag > maxLag {
+		return fmt.Errorf("%w: standby lags %s behind, which is more than %s", errRoleMismatch, lag.String(),
+			maxLag.String())
+	}
+	return nil
+}
+
+func verifySyncStandbys(ctx context.Context, pgConn *pgconn.PgConn, minimum int) error {
+	if minimum < 1 {
+		minimum = 1
+	}
+	value, err := queryValue(ctx, pgConn, syncStandbysQuery)
+	if err != nil {
+		return err
+	}
+	if num, err := strconv.Atoi(value); err != nil {
+		return err
+	} else if num < minimum {
+		return fmt.Errorf("%w: primary has %d sync standbys, which is less than %d", errRoleMismatch, num, minimum)
+	}
+	return nil
+}
+
+// verifySyncStandby checks (on the primary) that the standby is a sync standby.
+// This requires Hosts, since the standby itself does not know if it is a sync standby.
+func (c *Conn) verifySyncStandby(ctx context.Context, pgConn *pgconn.PgConn) error {
+	if !c.MultiHost() {
+		return fmt.Errorf("role %s requires a connection with hosts", RoleSyncStandby)
+	}
+	name, err := queryValue(ctx, pgConn, walReceiverNameQuery)
+	if err != nil {
+		return err
+	} else if name == "" {
+		return fmt.Errorf("%w: standby is not streaming", errRoleMismatch)
+	}
+	primary, err := c.pool(target{role: RolePrimary})
+	if err != nil {
+		return err
+	}
+	var num int
+	if err = primary.QueryRow(ctx, syncStandbyQuery, name).Scan(&num); err != nil {
+		return err
+	} else if num == 0 {
+		return fmt.Errorf("%w: standby %s is not a sync standby", errRoleMismatch, name)
+	}
+	return nil
+}
+
+// validator returns a function that verifies that a host has a role (with options),
+// or nil when every host is fine (for preferStandby and all).
+func (c *Conn) validator(t target) pgconn.ValidateConnectFunc {
+	switch t.role {
+	case RolePrimary:
+		return func(ctx context.Context, pgConn *pgconn.PgConn) error {
+			return verifyRecovery(ctx, pgConn, false)
+		}
+	case RolePrimaryWithSyncStandbys:
+		return func(ctx context.Context, pgConn *pgconn.PgConn) error {
+			if err := verifyRecovery(ctx, pgConn, false); err != nil {
+				return err
+			}
+			return verifySyncStandbys(ctx, pgConn, t.opts.SyncStandbys)
+		}
+	case RoleStandby:
+		return func(ctx context.Context, pgConn *pgconn.PgConn) error {
+			if err := verifyRecovery(ctx, pgConn, true); err != nil {
+				return err
+			}
+			return verifyLag(ctx, pgConn, t.opts.MaxLag)
+		}
+	case RoleSyncStandby:
+		return func(ctx context.Context, pgConn *pgconn.PgConn) error {
+			if err := verifyRecovery(ctx, pgConn, true); err != nil {
+				return err
+			} else if err = verifyLag(ctx, pgConn, t.opts.MaxLag); err != nil {
+				return err
+			}
+			return c.root().verifySyncStandby(ctx, pgConn)
+		}
+	}
+	return nil
+}
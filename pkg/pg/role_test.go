@@ -0,0 +1,17 @@
+package pg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLag(t *testing.T) {
+	assert.NoError(t, checkLag("0", 30*time.Second), "a standby that replayed all WAL does not lag")
+	assert.NoError(t, checkLag("12.5", 30*time.Second))
+	assert.ErrorIs(t, checkLag("45.1", 30*time.Second), errRoleMismatch)
+	assert.ErrorIs(t, checkLag("", 30*time.Second), errRoleMismatch,
+		"a standby with a disconnected wal receiver should not report a lag of 0")
+	assert.Error(t, checkLag("invalid", 30*time.Second))
+}
@@ -1,21 +1,112 @@
 package pg
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"strings"
+
+	"github.com/jackc/pgconn"
 )
 
 type Row []string
+
+// Contains returns true if one of the values in the row equals value
+func (r Row) Contains(value string) bool {
+	for _, v := range r {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Row) equal(other Row) bool {
+	if len(r) != len(other) {
+		return false
+	}
+	for i := range r {
+		if r[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Column holds all values of one column of a Result
+type Column []string
+
+// Contains returns true if one of the values in the column equals value
+func (c Column) Contains(value string) bool {
+	for _, v := range c {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Result holds the rows of one or more queries (see Append).
+// header holds all column names (in order of first appearance), and rowHeaders holds the column names of every row
+// (when rows of queries with different columns are combined), so that every value keeps its own column name.
 type Result struct {
-	header Row
-	rows   []Row
+	header     Row
+	rows       []Row
+	rowHeaders []Row
+	commandTag pgconn.CommandTag
+	notices    []string
+}
+
+// NewResult returns a Result with the specified columns and rows (e.a. for results that do not come from a query)
+func NewResult(header []string, rows ...Row) Result {
+	return Result{header: uniqueNames(header), rows: rows}
+}
+
+// uniqueNames returns the column names, where duplicate names get a suffix (e.a. `select 1 a, 2 a` has columns a and
+// a_2), so that no values are lost when rows are used as maps (or rendered as json)
+func uniqueNames(names []string) (unique Row) {
+	used := make(map[string]bool)
+	for _, name := range names {
+		uniqueName := name
+		for i := 2; used[uniqueName]; i++ {
+			uniqueName = fmt.Sprintf("%s_%d", name, i)
+		}
+		used[uniqueName] = true
+		unique = append(unique, uniqueName)
+	}
+	return unique
+}
+
+// rowHeader returns the column names of row i
+func (r Result) rowHeader(i int) Row {
+	if r.rowHeaders == nil {
+		return r.header
+	}
+	return r.rowHeaders[i]
+}
+
+// CommandTag returns the command tag of the query (e.a. `DELETE 3`)
+func (r Result) CommandTag() string {
+	return r.commandTag.String()
+}
+
+// RowsAffected returns the number of rows affected (or returned) by the query
+func (r Result) RowsAffected() int64 {
+	return r.commandTag.RowsAffected()
+}
+
+// Notices returns all notices (and warnings) that the server raised while running the query
+func (r Result) Notices() []string {
+	return r.notices
 }
 
 func (r Result) AsMapArray() (arraysOfMaps []map[string]string) {
-	for _, row := range r.rows {
+	for i, row := range r.rows {
+		header := r.rowHeader(i)
 		m := make(map[string]string)
-		for i, c := range row {
-			m[r.header[i]] = c
+		for j, c := range row {
+			m[header[j]] = c
 		}
 		arraysOfMaps = append(arraysOfMaps, m)
 	}
@@ -27,13 +118,101 @@ func (r Result) AsStringArray(params ...string) (arraysOfStrings []string) {
 	if len(params) > 0 {
 		delimiter = params[0]
 	}
-	for _, row := range r.rows {
+	for i, row := range r.rows {
+		header := r.rowHeader(i)
 		var cols []string
-		for i, col := range row {
-			cols = append(cols, fmt.Sprintf("{%s}={%s}", r.header[i],
+		for j, col := range row {
+			cols = append(cols, fmt.Sprintf("{%s}={%s}", header[j],
 				strings.Replace(col, "'", "''", -1)))
 		}
 		arraysOfStrings = append(arraysOfStrings, strings.Join(cols, delimiter))
 	}
 	return arraysOfStrings
 }
+
+// Header returns the column names of the result
+func (r Result) Header() Row {
+	return r.header
+}
+
+// Count returns the number of rows in the result
+func (r Result) Count() int {
+	return len(r.rows)
+}
+
+// First returns the first row as a map of column names to values (or an empty map if there are no rows)
+func (r Result) First() map[string]string {
+	if maps := r.AsMapArray(); len(maps) > 0 {
+		return maps[0]
+	}
+	return map[string]string{}
+}
+
+// Column returns all values of the column with the specified name (of all rows that have the column)
+func (r Result) Column(name string) (column Column) {
+	for i, row := range r.rows {
+		for j, colName := range r.rowHeader(i) {
+			if colName == name {
+				column = append(column, row[j])
+				break
+			}
+		}
+	}
+	return column
+}
+
+// Append returns a new Result with the rows of both result.
+// When the headers differ, the header of the new Result holds all columns (in order of first appearance), and every
+// row keeps its own columns (a row does not get values for columns it does not have).
+func (r Result) Append(other Result) (merged Result) {
+	used := make(map[string]bool)
+	for _, result := range []Result{r, other} {
+		for _, colName := range result.header {
+			if !used[colName] {
+				used[colName] = true
+				merged.header = append(merged.header, colName)
+			}
+		}
+	}
+	for _, result := range []Result{r, other} {
+		for i, row := range result.rows {
+			merged.rows = append(merged.rows, row)
+			merged.rowHeaders = append(merged.rowHeaders, result.rowHeader(i))
+		}
+	}
+	return merged
+}
+
+// AsCSV renders the result as csv, with the header as the first line.
+// When rows have different columns (see Append), a new header line is written before every row with other columns.
+func (r Result) AsCSV() string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if len(r.rows) == 0 && len(r.header) > 0 {
+		_ = w.Write(r.header)
+	}
+	for i, row := range r.rows {
+		if header := r.rowHeader(i); i == 0 || !header.equal(r.rowHeader(i-1)) {
+			_ = w.Write(header)
+		}
+		_ = w.Write(row)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// AsJSON renders the result as a json array of objects (one per row) with the columns of every row in order
+func (r Result) AsJSON() string {
+	var rows []string
+	for i, row := range r.rows {
+		header := r.rowHeader(i)
+		var cols []string
+		for j, col := range row {
+			name, _ := json.Marshal(header[j])
+			value, _ := json.Marshal(col)
+			cols = append(cols, fmt.Sprintf("%s:%s", name, value))
+		}
+		rows = append(rows, fmt.Sprintf("{%s}", strings.Join(cols, ",")))
+	}
+	return fmt.Sprintf("[%s]", strings.Join(rows, ","))
+}
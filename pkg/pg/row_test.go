@@ -0,0 +1,46 @@
+package pg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResult_Helpers(t *testing.T) {
+	r := Result{
+		header: Row{"datname", "oid"},
+		rows:   []Row{{"postgres", "5"}, {"my,db", "16384"}},
+	}
+	assert.Equal(t, 2, r.Count())
+	assert.Equal(t, map[string]string{"datname": "postgres", "oid": "5"}, r.First())
+	assert.Equal(t, Column{"postgres", "my,db"}, r.Column("datname"))
+	assert.True(t, r.Column("datname").Contains("my,db"))
+	assert.False(t, r.Column("datname").Contains("my"))
+	assert.Empty(t, r.Column("unknown"))
+	assert.Equal(t, "datname,oid\npostgres,5\n\"my,db\",16384\n", r.AsCSV())
+	assert.Equal(t, `[{"datname":"postgres","oid":"5"},{"datname":"my,db","oid":"16384"}]`, r.AsJSON())
+	assert.Empty(t, Result{}.First(), "First on an empty result should return an empty map")
+}
+
+func TestResult_Append(t *testing.T) {
+	r1 := Result{header: Row{"a", "b"}, rows: []Row{{"1", "2"}}}
+	r2 := Result{header: Row{"b", "c"}, rows: []Row{{"3", "4"}}}
+	merged := Result{}.Append(r1).Append(Result{}).Append(r2)
+	assert.Equal(t, Row{"a", "b", "c"}, merged.Header())
+	assert.Equal(t, []Row{{"1", "2"}, {"3", "4"}}, merged.rows)
+	assert.Equal(t, []map[string]string{{"a": "1", "b": "2"}, {"b": "3", "c": "4"}}, merged.AsMapArray(),
+		"missing columns should not be returned as empty values")
+	assert.Equal(t, Column{"2", "3"}, merged.Column("b"))
+	assert.Equal(t, Column{"4"}, merged.Column("c"))
+	assert.Equal(t, `[{"a":"1","b":"2"},{"b":"3","c":"4"}]`, merged.AsJSON())
+	assert.Equal(t, "a,b\n1,2\nb,c\n3,4\n", merged.AsCSV())
+	assert.Equal(t, []string{"{a}={1}, {b}={2}", "{b}={3}, {c}={4}"}, merged.AsStringArray())
+}
+
+func TestResult_DuplicateColumns(t *testing.T) {
+	assert.Equal(t, Row{"a", "a_2", "a_3", "b"}, uniqueNames([]string{"a", "a", "a", "b"}))
+	assert.Equal(t, Row{"a", "a_2", "a_3"}, uniqueNames([]string{"a", "a_2", "a"}))
+	r := Result{header: uniqueNames([]string{"a", "a"}), rows: []Row{{"1", "2"}}}
+	assert.Equal(t, map[string]string{"a": "1", "a_2": "2"}, r.First(), "duplicate columns should not lose values")
+	assert.Equal(t, `[{"a":"1","a_2":"2"}]`, r.AsJSON())
+}
@@ -0,0 +1,129 @@
+package pg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgconn"
+)
+
+// defaultApplicationName is used when neither the Conn, nor the query sets application_name
+const defaultApplicationName = "pgquartz"
+
+// SessionSettings are applied to a session before it is used.
+// Settings that are not set are reset to the default of the server (or the user / database).
+// SetRole switches to another database role (SET ROLE) after connecting.
+type SessionSettings struct {
+	ApplicationName    string `yaml:"application_name,omitempty"`
+	StatementTimeout   string `yaml:"statement_timeout,omitempty"`
+	LockTimeout        string `yaml:"lock_timeout,omitempty"`
+	SearchPath         string `yaml:"search_path,omitempty"`
+	WorkMem            string `yaml:"work_mem,omitempty"`
+	MaintenanceWorkMem string `yaml:"maintenance_work_mem,omitempty"`
+	SetRole            string `yaml:"setRole,omitempty"`
+}
+
+// Merge returns the settings, where all settings that are set in overrides replace the original settings
+func (ss SessionSettings) Merge(overrides SessionSettings) SessionSettings {
+	for _, setting := range []struct {
+		value    *string
+		override string
+	}{
+		{&ss.ApplicationName, overrides.ApplicationName},
+		{&ss.StatementTimeout, overrides.StatementTimeout},
+		{&ss.LockTimeout, overrides.LockTimeout},
+		{&ss.SearchPath, overrides.SearchPath},
+		{&ss.WorkMem, overrides.WorkMem},
+		{&ss.MaintenanceWorkMem, overrides.MaintenanceWorkMem},
+		{&ss.SetRole, overrides.SetRole},
+	} {
+		if setting.override != "" {
+			*setting.value = setting.override
+		}
+	}
+	return ss
+}
+
+// parameters returns all settings as a list of PostgreSQL parameter names and values (where role is SetRole)
+func (ss SessionSettings) parameters() [][2]string {
+	return [][2]string{
+		{"application_name", ss.ApplicationName},
+		{"statement_timeout", ss.StatementTimeout},
+		{"lock_timeout", ss.LockTimeout},
+		{"search_path", ss.SearchPath},
+		{"work_mem", ss.WorkMem},
+		{"maintenance_work_mem", ss.MaintenanceWorkMem},
+		{"role", ss.SetRole},
+	}
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// SQL returns the statements that apply the settings to a session.
+// set_config is used (instead of SET), so that values are parsed like they would be in postgresql.conf
+// (e.a. search_path 'a, b' sets two schemas).
+func (ss SessionSettings) SQL() string {
+	var resets, configs []string
+	for _, parameter := range ss.parameters() {
+		if name, value := parameter[0], parameter[1]; value == "" {
+			resets = append(resets, fmt.Sprintf("RESET %s;", name))
+		} else {
+			configs = append(configs, fmt.Sprintf("set_config(%s, %s, false)", quoteLiteral(name),
+				quoteLiteral(value)))
+		}
+	}
+	if len(configs) > 0 {
+		resets = append(resets, fmt.Sprintf("SELECT %s;", strings.Join(configs, ", ")))
+	}
+	return strings.Join(resets, " ")
+}
+
+// sessionSettings returns the settings for a query (defaults, overruled by the Conn, overruled by the query)
+func (c *Conn) sessionSettings(overrides SessionSettings) SessionSettings {
+	return SessionSettings{ApplicationName: defaultApplicationName}.Merge(c.Session).Merge(overrides)
+}
+
+// applySession applies the settings to a session, unless they already are applied.
+// Settings are applied on every acquire, since queries (sharing a session) can have different settings.
+func (c *Conn) applySession(pgConn *pgconn.PgConn, settings SessionSettings) error {
+	root := c.root()
+	sql := settings.SQL()
+	root.appliedLock.Lock()
+	applied := root.applied[pgConn]
+	root.appliedLock.Unlock()
+	if applied == sql {
+		return nil
+	}
+	_, err := pgConn.Exec(ctx, sql).ReadAll()
+	root.appliedLock.Lock()
+	defer root.appliedLock.Unlock()
+	if err != nil {
+		delete(root.applied, pgConn)
+		return fmt.Errorf("could not apply session settings: %w", err)
+	}
+	if root.applied == nil {
+		root.applied = make(map[*pgconn.PgConn]string)
+	}
+	// The pool also closes connections without a hook (e.a. when idle for too long, or broken on release),
+	// so closed connections are forgotten here as well
+	for appliedConn := range root.applied {
+		if appliedConn.IsClosed() {
+			delete(root.applied, appliedConn)
+		}
+	}
+	root.applied[pgConn] = sql
+	return nil
+}
+
+// forgetSession forgets the applied settings (and all collected notices) of a connection that is closed or dropped
+func (c *Conn) forgetSession(pgConn *pgconn.PgConn) {
+	root := c.root()
+	root.appliedLock.Lock()
+	delete(root.applied, pgConn)
+	root.appliedLock.Unlock()
+	root.noticeLock.Lock()
+	delete(root.notices, pgConn)
+	root.noticeLock.Unlock()
+}
@@ -0,0 +1,53 @@
+package pg
+
+import (
+	"testing"
+
+	"github.com/jackc/pgconn"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionSettings_Merge(t *testing.T) {
+	defaults := SessionSettings{ApplicationName: "job", StatementTimeout: "1min", SetRole: "owner"}
+	merged := defaults.Merge(SessionSettings{StatementTimeout: "0", LockTimeout: "5s"})
+	assert.Equal(t, SessionSettings{ApplicationName: "job", StatementTimeout: "0", LockTimeout: "5s", SetRole: "owner"},
+		merged)
+	assert.Equal(t, "1min", defaults.StatementTimeout, "merging should not change the original settings")
+}
+
+func TestSessionSettings_SQL(t *testing.T) {
+	sql := SessionSettings{ApplicationName: "pgquartz/o'neil", SearchPath: "app, public", SetRole: "owner"}.SQL()
+	assert.Equal(t, "RESET statement_timeout; RESET lock_timeout; RESET work_mem; RESET maintenance_work_mem; "+
+		"SELECT set_config('application_name', 'pgquartz/o''neil', false), set_config('search_path', 'app, public', "+
+		"false), set_config('role', 'owner', false);", sql)
+	assert.Contains(t, SessionSettings{}.SQL(), "RESET role;", "unset settings should be reset")
+	assert.NotContains(t, SessionSettings{}.SQL(), "SELECT")
+}
+
+func TestConn_SessionSettings(t *testing.T) {
+	c := NewConn(Dsn{})
+	assert.Equal(t, "pgquartz", c.sessionSettings(SessionSettings{}).ApplicationName)
+	c.Session = SessionSettings{ApplicationName: "reporting", LockTimeout: "1s"}
+	assert.Equal(t, SessionSettings{ApplicationName: "reporting", LockTimeout: "2s"},
+		c.Pin().sessionSettings(SessionSettings{LockTimeout: "2s"}))
+}
+
+func TestConn_ForgetSession(t *testing.T) {
+	c := NewConn(Dsn{})
+	// Connections that are not connected are closed
+	conn1, conn2 := &pgconn.PgConn{}, &pgconn.PgConn{}
+	c.applied = map[*pgconn.PgConn]string{conn1: "RESET role;", conn2: "RESET role;"}
+	c.onNotice(conn1, &pgconn.Notice{Severity: "NOTICE", Message: "one"})
+	c.Pin().forgetSession(conn1)
+	assert.Equal(t, map[*pgconn.PgConn]string{conn2: "RESET role;"}, c.applied,
+		"a dropped connection should be forgotten")
+	assert.Empty(t, c.takeNotices(conn1))
+
+	c.onNotice(conn2, &pgconn.Notice{Severity: "NOTICE", Message: "two"})
+	c.Pin().Close()
+	assert.Len(t, c.applied, 1, "closing a pinned session should not forget the connections of the pool")
+	c.Close()
+	assert.Empty(t, c.applied, "closing the pools should forget all connections")
+	assert.Empty(t, c.notices)
+}
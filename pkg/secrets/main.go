@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Masked replaces secret values in everything that is printed (see Mask)
+const Masked = "*****"
+
+// Provider resolves references (the part after `<provider name>:`) into secret values
+type Provider interface {
+	Resolve(reference string) (string, error)
+}
+
+var (
+	providers = map[string]Provider{
+		providerEnv:     envProvider{},
+		providerFile:    fileProvider{},
+		providerCommand: commandProvider{},
+		providerVault:   vaultProvider{},
+	}
+	// resolved holds all values that are resolved, so that they can be masked
+	resolved     = make(map[string]bool)
+	resolvedLock sync.Mutex
+)
+
+// RegisterProvider registers a Provider, so that it can be used with `<name>:<reference>` in the config.
+// Registering a Provider for a name that is already registered replaces the existing Provider.
+func RegisterProvider(name string, provider Provider) {
+	if name == "" {
+		panic("cannot register a secret provider without a name")
+	}
+	providers[name] = provider
+}
+
+// Providers returns the names of all registered Providers (sorted)
+func Providers() (names []string) {
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsReference returns true for values that reference a secret (e.a. `env:PGPASSWORD`).
+// Multi line values (e.a. inline scripts) and values that look like an url (e.a. `file:///srv/repo.git`) are no
+// references.
+func IsReference(value string) bool {
+	name, reference, found := strings.Cut(value, ":")
+	if !found || strings.Contains(value, "\n") || strings.HasPrefix(reference, "//") {
+		return false
+	}
+	_, exists := providers[name]
+	return exists
+}
+
+// Resolve returns the secret value for a reference, and returns all other values as is
+func Resolve(value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+	name, reference, _ := strings.Cut(value, ":")
+	secret, err := providers[name].Resolve(reference)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve secret %s: %w", value, err)
+	}
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+	if secret != "" {
+		resolved[secret] = true
+	}
+	return secret, nil
+}
+
+// Mask replaces all resolved secret values, and all other values that are passed, in a text (e.a. a config dump)
+// with Masked
+func Mask(text string, values ...string) string {
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+	var secrets []string
+	for secret := range resolved {
+		secrets = append(secrets, secret)
+	}
+	for _, value := range values {
+		if value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+	// Longest first, so that secrets that contain other secrets are masked completely
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, Masked)
+	}
+	return text
+}
@@ -0,0 +1,91 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestIsReference(t *testing.T) {
+	assert.True(t, IsReference("env:PGPASSWORD"))
+	assert.True(t, IsReference("command:pass show pg"))
+	assert.False(t, IsReference("supassword"))
+	assert.False(t, IsReference("file:///srv/jobs.git"), "urls are no references")
+	assert.False(t, IsReference("env: a\nb"), "multi line values are no references")
+	assert.False(t, IsReference("unknown:value"))
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv("PGQ_TEST_SECRET", "from env")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("from file\n"), 0600))
+
+	for reference, expected := range map[string]string{
+		"env:PGQ_TEST_SECRET":       "from env",
+		"file:" + secretFile:        "from file",
+		"command:echo from command": "from command",
+		"plain value":               "plain value",
+	} {
+		secret, err := Resolve(reference)
+		assert.NoError(t, err, reference)
+		assert.Equal(t, expected, secret, reference)
+	}
+	for _, reference := range []string{"env:PGQ_TEST_UNSET", "file:/does/not/exist", "command:exit 1"} {
+		_, err := Resolve(reference)
+		assert.Error(t, err, reference)
+	}
+	assert.Equal(t, "password=*****, user=*****", Mask("password=from env, user=from command"))
+}
+
+func TestResolveYaml(t *testing.T) {
+	t.Setenv("PGQ_TEST_PASSWORD", "s3cr3t")
+	document := []byte(`connections:
+  pg:
+    conn_params:
+      password: env:PGQ_TEST_PASSWORD
+git:
+  url: file:///srv/jobs.git
+steps:
+  s1:
+    commands:
+      - inline: echo env:PGQ_TEST_PASSWORD
+`)
+	resolved, err := ResolveYaml(document)
+	assert.NoError(t, err)
+	var tree map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal(resolved, &tree))
+	connParams := tree["connections"].(map[interface{}]interface{})["pg"].(map[interface{}]interface{})["conn_params"]
+	assert.Equal(t, "s3cr3t", connParams.(map[interface{}]interface{})["password"])
+	assert.Equal(t, "file:///srv/jobs.git", tree["git"].(map[interface{}]interface{})["url"])
+	assert.Contains(t, string(resolved), "echo env:PGQ_TEST_PASSWORD", "only complete values are references")
+
+	unchanged := []byte("steps: {}\n# a comment\n")
+	resolved, err = ResolveYaml(unchanged)
+	assert.NoError(t, err)
+	assert.Equal(t, unchanged, resolved, "documents without references are returned as is")
+
+	scalars := []byte(`version: 1.10
+enabled: yes
+mode: 0600
+ids: [010]
+password: env:PGQ_TEST_PASSWORD
+`)
+	resolved, err = ResolveYaml(scalars)
+	assert.NoError(t, err)
+	var original, resolvedTree map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal(scalars, &original))
+	assert.NoError(t, yaml.Unmarshal(resolved, &resolvedTree))
+	assert.Equal(t, "s3cr3t", resolvedTree["password"])
+	delete(resolvedTree, "password")
+	delete(original, "password")
+	assert.Equal(t, original, resolvedTree, "values next to references should be read exactly as without references")
+	for _, notation := range []string{"1.10", "yes", "0600", "010"} {
+		assert.Contains(t, string(resolved), notation, "values next to references should keep their notation")
+	}
+
+	_, err = ResolveYaml([]byte("password: env:PGQ_TEST_UNSET\n"))
+	assert.Error(t, err)
+}
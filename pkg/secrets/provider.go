@@ -0,0 +1,59 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	providerEnv     = "env"
+	providerFile    = "file"
+	providerCommand = "command"
+	providerVault   = "vault"
+)
+
+// envProvider resolves `env:<variable>` into the value of the environment variable
+type envProvider struct{}
+
+func (ep envProvider) Resolve(reference string) (string, error) {
+	if value, exists := os.LookupEnv(reference); exists {
+		return value, nil
+	}
+	return "", fmt.Errorf("environment variable %s is not set", reference)
+}
+
+// fileProvider resolves `file:<path>` into the contents of the file (without the trailing newline)
+type fileProvider struct{}
+
+func (fp fileProvider) Resolve(reference string) (string, error) {
+	path, err := homedir.Expand(reference)
+	if err != nil {
+		return "", err
+	}
+	// #nosec G304 -- reading secrets from files that are defined in the config is the whole point
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// commandProvider resolves `command:<command>` into the output of the command (without the trailing newline).
+// The command is run in bash, and should exit with 0.
+type commandProvider struct{}
+
+func (cp commandProvider) Resolve(reference string) (string, error) {
+	command := exec.Command("/bin/bash", "-c", reference) // #nosec
+	var stdOut, stdErr bytes.Buffer
+	command.Stdout = &stdOut
+	command.Stderr = &stdErr
+	if err := command.Run(); err != nil {
+		return "", fmt.Errorf("%s (%s)", err.Error(), strings.TrimSpace(stdErr.String()))
+	}
+	return strings.TrimRight(stdOut.String(), "\r\n"), nil
+}
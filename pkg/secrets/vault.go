@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	envVaultAddr      = "VAULT_ADDR"
+	envVaultToken     = "VAULT_TOKEN"
+	envVaultNamespace = "VAULT_NAMESPACE"
+	vaultTimeout      = 30 * time.Second
+)
+
+// vaultResponse is the part of a Vault KV read response that we need.
+// For KV version 1, the values are in Data, for KV version 2 they are in Data["data"].
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+// vaultProvider resolves `vault:<path>#<key>` into a value from the HashiCorp Vault KV secrets engine.
+// For KV version 2 the path should contain `data` (e.a. `vault:secret/data/pgquartz#password`).
+// The Vault server and token are read from VAULT_ADDR, VAULT_TOKEN and (optionally) VAULT_NAMESPACE.
+type vaultProvider struct{}
+
+func (vp vaultProvider) Resolve(reference string) (string, error) {
+	path, key, found := strings.Cut(reference, "#")
+	if !found || path == "" || key == "" {
+		return "", fmt.Errorf("vault references should be formatted as vault:<path>#<key>")
+	}
+	addr := os.Getenv(envVaultAddr)
+	if addr == "" {
+		return "", fmt.Errorf("%s is not set", envVaultAddr)
+	}
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s", strings.TrimRight(addr, "/"),
+		strings.TrimLeft(path, "/")), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", os.Getenv(envVaultToken))
+	if namespace := os.Getenv(envVaultNamespace); namespace != "" {
+		request.Header.Set("X-Vault-Namespace", namespace)
+	}
+	client := &http.Client{Timeout: vaultTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	var vaultResp vaultResponse
+	if err = json.Unmarshal(body, &vaultResp); err != nil {
+		return "", fmt.Errorf("invalid response from vault (%s): %s", response.Status, err.Error())
+	} else if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s: %s", response.Status, strings.Join(vaultResp.Errors, ", "))
+	}
+	data := vaultResp.Data
+	if kv2Data, isKv2 := data["data"].(map[string]interface{}); isKv2 {
+		data = kv2Data
+	}
+	value, exists := data[key]
+	if !exists {
+		return "", fmt.Errorf("vault secret %s has no key %s", path, key)
+	} else if strValue, isString := value.(string); isString {
+		return strValue, nil
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,46 @@
+package secrets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "my-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/pgquartz":
+			_, _ = w.Write([]byte(`{"data": {"data": {"password": "kv2"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/pgquartz":
+			_, _ = w.Write([]byte(`{"data": {"password": "kv1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv(envVaultAddr, server.URL+"/")
+	t.Setenv(envVaultToken, "my-token")
+
+	secret, err := Resolve("vault:secret/data/pgquartz#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "kv2", secret)
+	secret, err = Resolve("vault:/kv/pgquartz#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "kv1", secret)
+
+	for _, reference := range []string{"vault:kv/pgquartz#user", "vault:kv/other#password", "vault:kv/pgquartz"} {
+		_, err = Resolve(reference)
+		assert.Error(t, err, reference)
+	}
+	t.Setenv(envVaultToken, "wrong")
+	_, err = Resolve("vault:kv/pgquartz#password")
+	assert.ErrorContains(t, err, "permission denied")
+}
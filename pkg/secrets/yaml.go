@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ResolveYaml resolves all secret references in the (string) values of a yaml document.
+// When the document has no references, it is returned as is.
+// Only the values that are references are replaced (and quoted), so that all other values keep their original
+// notation (e.a. `1.10`, `yes` and `0600`), exactly as the config would read them without references.
+func ResolveYaml(document []byte) ([]byte, error) {
+	var tree yaml.Node
+	if err := yaml.Unmarshal(document, &tree); err != nil {
+		return nil, err
+	}
+	changed, err := resolveNode(&tree)
+	if err != nil {
+		return nil, err
+	} else if !changed {
+		return document, nil
+	}
+	var resolved bytes.Buffer
+	encoder := yaml.NewEncoder(&resolved)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(&tree); err != nil {
+		return nil, err
+	}
+	if err = encoder.Close(); err != nil {
+		return nil, err
+	}
+	return resolved.Bytes(), nil
+}
+
+// resolveNode replaces all string scalars (in node and its children) that are references with their secret.
+// Aliases are not followed, since the node they refer to (the anchor) is resolved itself.
+func resolveNode(node *yaml.Node) (changed bool, err error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" || !IsReference(node.Value) {
+			return false, nil
+		}
+		secret, err := Resolve(node.Value)
+		if err != nil {
+			return false, err
+		}
+		node.Value = secret
+		node.Tag = "!!str"
+		node.Style = yaml.DoubleQuotedStyle
+		return true, nil
+	case yaml.DocumentNode, yaml.SequenceNode, yaml.MappingNode:
+		for _, child := range node.Content {
+			childChanged, err := resolveNode(child)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || childChanged
+		}
+	}
+	return changed, nil
+}